@@ -15,6 +15,12 @@ docker build -t dichlorodiphen/client .
 docker push dichlorodiphen/client
 cd ..
 
+# create the token signing key, which is not kept in the repository, unless
+# it already exists
+if ! minikube kubectl -- get secret jwt-signing-key > /dev/null 2>&1; then
+  minikube kubectl -- create secret generic jwt-signing-key --from-literal=secret="$(openssl rand -base64 48)"
+fi
+
 # redeploy
 minikube kubectl -- apply -Rf deployment/
 minikube kubectl -- get pods
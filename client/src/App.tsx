@@ -3,9 +3,37 @@ import "./fonts.css";
 import Auth from "./pages/Auth";
 import Chat from "./pages/Chat";
 import { useCookies } from "react-cookie";
+import { useEffect } from "react";
+
+// Delay between refreshes of the access token, which expires after 15 minutes.
+const REFRESH_INTERVAL_MS = 10 * 60 * 1000;
 
 function App() {
-    const [cookies, setCookie, removeCookie] = useCookies(["token"]);
+    const [cookies, setCookie, removeCookie] = useCookies(["token", "refreshToken"]);
+
+    // Exchange the refresh token for new tokens before the access token
+    // expires. Refresh tokens can only be used once.
+    useEffect(() => {
+        if (!cookies["refreshToken"]) {
+            return;
+        }
+        const interval = setInterval(async () => {
+            const response = await fetch("http://127.0.0.1:8000/users/refresh", {
+                method: "POST",
+                body: JSON.stringify({ refreshToken: cookies["refreshToken"] }),
+            });
+            if (response.status != 200) {
+                removeCookie("token");
+                removeCookie("refreshToken");
+                return;
+            }
+            const tokens = await response.json();
+            setCookie("token", tokens.accessToken);
+            setCookie("refreshToken", tokens.refreshToken);
+        }, REFRESH_INTERVAL_MS);
+
+        return () => clearInterval(interval);
+    }, [cookies["refreshToken"]]);
 
     if (!cookies["token"]) {
         return <Auth></Auth>;
@@ -8,7 +8,7 @@ import { useCookies } from "react-cookie";
 function Auth() {
     const [username, setUsername] = useState("");
     const [password, setPassword] = useState("");
-    const setCookie = useCookies(["token"])[1];
+    const setCookie = useCookies(["token", "refreshToken"])[1];
 
     function onUsernameChange(e: React.FormEvent<HTMLInputElement>) {
         setUsername(e.currentTarget.value);
@@ -31,10 +31,12 @@ function Auth() {
             }),
         });
 
-        const token = await data.text();
-        console.log(`Got the following from signup endpoint: ${token}`);
+        const body = await data.text();
+        console.log(`Got the following from signup endpoint: ${body}`);
         if (data.status == 201) {
-            setCookie("token", token);
+            const tokens = JSON.parse(body);
+            setCookie("token", tokens.accessToken);
+            setCookie("refreshToken", tokens.refreshToken);
         }
     }
 
@@ -51,10 +53,12 @@ function Auth() {
             }),
         });
 
-        const token = await data.text();
-        console.log(`Got the following from login endpoint: ${token}`);
+        const body = await data.text();
+        console.log(`Got the following from login endpoint: ${body}`);
         if (data.status == 200) {
-            setCookie("token", token);
+            const tokens = JSON.parse(body);
+            setCookie("token", tokens.accessToken);
+            setCookie("refreshToken", tokens.refreshToken);
         }
     }
 
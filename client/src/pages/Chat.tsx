@@ -1,10 +1,11 @@
 import "./Chat.css";
 
-import { useEffect, useState } from "react";
+import { useEffect, useRef, useState } from "react";
 
 import Logo from "../components/Logo";
 import Message from "../components/Message";
 import { useCookies } from "react-cookie";
+import { ReadyState } from "react-use-websocket";
 import { useWebSocket } from "react-use-websocket/dist/lib/use-websocket";
 
 type ChatProps = {
@@ -17,17 +18,68 @@ type Message = {
     content: string;
     votes: string;
     created: string;
+    edited?: string;
+    deleted?: string;
+    parentID?: string;
+    replyCount?: number;
+    lastReply?: string;
+    reactions?: Reaction[];
 };
 
+type Reaction = {
+    emoji: string;
+    count: number;
+    users: string[];
+};
+
+// Envelope of a frame streamed over the websocket. The type determines the
+// shape of the payload.
+type Event = { v: number; id: string; ts: string } & (
+    | { type: "message_created"; payload: Message }
+    | { type: "message_edited"; payload: Message }
+    | { type: "message_deleted"; payload: Message }
+    | { type: "vote_updated"; payload: { id: string; votes: number } }
+    | {
+          type: "thread_updated";
+          payload: { id: string; replyCount: number; lastReply: string };
+      }
+    | { type: "reaction_changed"; payload: { id: string } & Reaction }
+    | {
+          type: "read_receipt";
+          payload: { username: string; messageID: string; read: string };
+      }
+    | {
+          type: "unread_counts";
+          payload: { channel?: string; conversation?: string; unread: number }[];
+      }
+    | {
+          type: "presence_changed";
+          payload: { username: string; state: string; lastSeen?: string };
+      }
+    | { type: "typing"; payload: { username: string; typing: boolean } }
+    | { type: "authenticated"; payload: { expires: string } }
+    | { type: "error"; payload: { ref?: string; message: string } }
+);
+
 const WS_URL = "ws://127.0.0.1:8000/ws";
 
+// Minimum delay between typing frames while the user keeps typing. The server
+// expires typing state after 5 seconds without one.
+const TYPING_INTERVAL_MS = 2000;
+
 function Chat({ token }: ChatProps) {
     // Current message being composed.
     const [text, setText] = useState("");
 
     const [history, setHistory] = useState<Message[]>([]);
 
-    const removeCookie = useCookies(["token"])[2];
+    // Usernames of other users typing in the channel.
+    const [typing, setTyping] = useState<string[]>([]);
+
+    // When the last typing frame was sent, in milliseconds since the epoch.
+    const lastTypingFrame = useRef(0);
+
+    const removeCookie = useCookies(["token", "refreshToken"])[2];
 
     // Set up websocket.
     const { sendMessage, lastMessage, readyState } = useWebSocket(WS_URL, {
@@ -37,19 +89,120 @@ function Chat({ token }: ChatProps) {
         },
         onMessage: (m) => {
             console.log(`Received data: ${m.data}`);
-            const message: Message = JSON.parse(m.data);
-            setHistory([...history, message]);
+            const event: Event = JSON.parse(m.data);
+            switch (event.type) {
+                case "message_created":
+                    // Replies are only streamed to clients viewing the thread.
+                    if (!event.payload.parentID) {
+                        setHistory((h) => [...h, event.payload]);
+                        markRead(event.payload.id);
+                    }
+                    break;
+                case "message_edited":
+                case "message_deleted":
+                    setHistory((h) =>
+                        h.map((message) =>
+                            message.id === event.payload.id ? event.payload : message
+                        )
+                    );
+                    break;
+                case "vote_updated":
+                    setHistory((h) =>
+                        h.map((message) =>
+                            message.id === event.payload.id
+                                ? { ...message, votes: String(event.payload.votes) }
+                                : message
+                        )
+                    );
+                    break;
+                case "thread_updated":
+                    setHistory((h) =>
+                        h.map((message) =>
+                            message.id === event.payload.id
+                                ? {
+                                      ...message,
+                                      replyCount: event.payload.replyCount,
+                                      lastReply: event.payload.lastReply,
+                                  }
+                                : message
+                        )
+                    );
+                    break;
+                case "reaction_changed":
+                    setHistory((h) =>
+                        h.map((message) => {
+                            if (message.id !== event.payload.id) {
+                                return message;
+                            }
+                            const reaction: Reaction = {
+                                emoji: event.payload.emoji,
+                                count: event.payload.count,
+                                users: event.payload.users,
+                            };
+                            const reactions = (message.reactions ?? [])
+                                .filter((r) => r.emoji !== reaction.emoji)
+                                .concat(reaction.count > 0 ? [reaction] : [])
+                                .sort((a, b) => (a.emoji < b.emoji ? -1 : 1));
+                            return { ...message, reactions };
+                        })
+                    );
+                    break;
+                case "typing":
+                    setTyping((t) =>
+                        event.payload.typing
+                            ? t.includes(event.payload.username)
+                                ? t
+                                : [...t, event.payload.username]
+                            : t.filter((u) => u !== event.payload.username)
+                    );
+                    break;
+                case "read_receipt":
+                    console.log(
+                        `${event.payload.username} read up to ${event.payload.messageID}`
+                    );
+                    break;
+                case "unread_counts":
+                    console.log(`Unread counts: ${JSON.stringify(event.payload)}`);
+                    break;
+                case "presence_changed":
+                    console.log(`${event.payload.username} is ${event.payload.state}`);
+                    break;
+                case "error":
+                    console.error(`Websocket error: ${event.payload.message}`);
+                    break;
+            }
         },
     });
 
     function onTextChange(e: React.FormEvent<HTMLInputElement>) {
-        setText(e.currentTarget.value);
+        const value = e.currentTarget.value;
+        setText(value);
+
+        if (value === "") {
+            sendTyping("stop");
+        } else if (Date.now() - lastTypingFrame.current > TYPING_INTERVAL_MS) {
+            sendTyping("start");
+        }
+    }
+
+    function sendTyping(state: "start" | "stop") {
+        lastTypingFrame.current = state === "start" ? Date.now() : 0;
+        sendMessage(
+            JSON.stringify({
+                v: 1,
+                type: "typing",
+                id: crypto.randomUUID(),
+                payload: { state },
+                ts: new Date().toISOString(),
+            })
+        );
     }
 
     async function onKeyUp(e: React.KeyboardEvent<HTMLInputElement>) {
         if (e.key === "Enter") {
             console.log(`Sending message ${text}`);
             setText("");
+            lastTypingFrame.current = 0;
             await createMessage(text);
         }
     }
@@ -67,6 +220,19 @@ function Chat({ token }: ChatProps) {
         console.log(response);
     }
 
+    // Mark every message up to and including the given one as read.
+    function markRead(id: string) {
+        sendMessage(
+            JSON.stringify({
+                v: 1,
+                type: "ack",
+                id: crypto.randomUUID(),
+                payload: { message: id },
+                ts: new Date().toISOString(),
+            })
+        );
+    }
+
     async function getAllMessages(): Promise<Message[]> {
         console.log(`trying to get all messages`);
 
@@ -77,17 +243,52 @@ function Chat({ token }: ChatProps) {
             },
         });
 
-        return JSON.parse(await response.text());
+        // TODO: Load older pages with the next cursor when scrolling up.
+        return JSON.parse(await response.text()).messages;
     }
 
-    function logOut() {
+    async function logOut() {
+        // Revoke the session on the server so the tokens cannot be reused.
+        await fetch("http://127.0.0.1:8000/users/logout", {
+            method: "POST",
+            headers: {
+                Authorization: "Bearer " + token,
+            },
+        });
         removeCookie("token");
+        removeCookie("refreshToken");
     }
 
+    // Re-authenticate the websocket in place whenever the access token is
+    // refreshed, so the server does not close it when the old token expires.
+    useEffect(() => {
+        if (readyState !== ReadyState.OPEN) {
+            return;
+        }
+        sendMessage(
+            JSON.stringify({
+                v: 1,
+                type: "authenticate",
+                id: crypto.randomUUID(),
+                payload: { token },
+                ts: new Date().toISOString(),
+            })
+        );
+    }, [token]);
+
     useEffect(() => {
         getAllMessages()
             .then((arr) => {
                 setHistory(arr);
+                if (arr.length > 0) {
+                    // The websocket may not be authenticated yet, so use REST.
+                    fetch(`http://127.0.0.1:8000/messages/${arr[arr.length - 1].id}/read`, {
+                        method: "POST",
+                        headers: {
+                            Authorization: "Bearer " + token,
+                        },
+                    });
+                }
             })
             .catch((e) => {
                 console.error(e);
@@ -105,7 +306,7 @@ function Chat({ token }: ChatProps) {
                             <Message
                                 id={m.id}
                                 author={m.author}
-                                content={m.content}
+                                content={m.deleted ? "[deleted]" : m.content}
                                 votes={m.votes}
                                 created={m.created}
                                 token={token}
@@ -113,6 +314,10 @@ function Chat({ token }: ChatProps) {
                         );
                     })}
                 </div>
+                <div className="chat-typing">
+                    {typing.length === 1 && `${typing[0]} is typing…`}
+                    {typing.length > 1 && `${typing.join(", ")} are typing…`}
+                </div>
                 <input
                     className="chat-input"
                     onKeyUp={onKeyUp}
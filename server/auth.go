@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,35 +10,30 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// Replace this with an environment variable.
-var JWT_SIGNING_KEY = []byte("secret")
-
-// Generate a signed JWT for the given username.
-func generateJWT(username string) (string, error) {
+// Generate a signed, short-lived access token for the given username in the
+// given session, carrying the user's roles.
+func (s *Server) generateJWT(username string, session string, roles []Role) (string, error) {
 	claims := JwtClaims{
 		username,
+		session,
+		roles,
 		jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ID:        primitive.NewObjectID().Hex(),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(s.config.AccessTokenLifetime)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
-	return token.SignedString(JWT_SIGNING_KEY)
+	return s.keys.sign(claims)
 }
 
 // Verifies and extracts claims from a signed JWT.
-func verifyJWTToken(signedString string) (jwt.Claims, error) {
-	token, err := jwt.Parse(signedString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-
-		return JWT_SIGNING_KEY, nil
-	})
+func (s *Server) verifyJWTToken(signedString string) (jwt.Claims, error) {
+	token, err := jwt.Parse(signedString, s.keys.verificationKey)
 	if err != nil {
 		return nil, err
 	}
@@ -48,8 +44,90 @@ func verifyJWTToken(signedString string) (jwt.Claims, error) {
 	return token.Claims, err
 }
 
+// The claims of a verified access token that the server relies on.
+type AccessClaims struct {
+	Username string
+
+	// Unique ID of the token (the jti claim).
+	ID string
+
+	// ID of the session the token was issued in (the sid claim), which is
+	// shared with the session's refresh tokens.
+	Session string
+
+	// Roles the user held when the token was issued, including roleUser.
+	Roles []Role
+
+	Expires time.Time
+}
+
+// Verify a signed access token, make sure it has not been revoked, and return
+// its claims.
+func (s *Server) verifyAccessToken(signedString string) (AccessClaims, error) {
+	claims, err := s.verifyJWTToken(signedString)
+	if err != nil {
+		return AccessClaims{}, err
+	}
+	mapClaims := claims.(jwt.MapClaims)
+
+	var accessClaims AccessClaims
+	var ok bool
+	if accessClaims.Username, ok = mapClaims["username"].(string); !ok {
+		return AccessClaims{}, fmt.Errorf("token has no username")
+	}
+	if accessClaims.ID, ok = mapClaims["jti"].(string); !ok {
+		return AccessClaims{}, fmt.Errorf("token has no ID")
+	}
+	if accessClaims.Session, ok = mapClaims["sid"].(string); !ok {
+		return AccessClaims{}, fmt.Errorf("token has no session")
+	}
+	roles, _ := mapClaims["roles"].([]interface{})
+	for _, role := range roles {
+		if role, ok := role.(string); ok {
+			accessClaims.Roles = append(accessClaims.Roles, Role(role))
+		}
+	}
+	accessClaims.Roles = allRoles(accessClaims.Roles)
+	expires, err := claims.GetExpirationTime()
+	if err != nil || expires == nil {
+		return AccessClaims{}, fmt.Errorf("token has no expiration time")
+	}
+	accessClaims.Expires = expires.Time
+
+	user, err := s.store.GetUser(s.ctx, accessClaims.Username)
+	if err != nil {
+		if err == errNotFound {
+			return AccessClaims{}, fmt.Errorf("user does not exist")
+		}
+		return AccessClaims{}, err
+	}
+	if user.Banned {
+		return AccessClaims{}, fmt.Errorf("user is banned")
+	}
+
+	revoked, err := s.store.AreTokensRevoked(s.ctx, []string{accessClaims.ID, accessClaims.Session})
+	if err != nil {
+		return AccessClaims{}, err
+	}
+	if revoked {
+		return AccessClaims{}, fmt.Errorf("token has been revoked")
+	}
+
+	return accessClaims, nil
+}
+
+// Key under which authenticationMiddleware stores the request's AccessClaims
+// in its context.
+type claimsContextKey struct{}
+
+// Return the claims of the request's access token. Must only be called behind
+// authenticationMiddleware.
+func requestClaims(r *http.Request) AccessClaims {
+	return r.Context().Value(claimsContextKey{}).(AccessClaims)
+}
+
 // Authenticates with JWT and updates header with claim information.
-func authenticationMiddleware(next http.Handler) http.Handler {
+func (s *Server) authenticationMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Read and proceess signed string.
 		signedString := r.Header.Get("Authorization")
@@ -60,7 +138,7 @@ func authenticationMiddleware(next http.Handler) http.Handler {
 		signedString = strings.Replace(signedString, "Bearer ", "", 1)
 
 		// Verify signed string and extract claims.
-		claims, err := verifyJWTToken(signedString)
+		claims, err := s.verifyAccessToken(signedString)
 		if err != nil {
 			log.Println("Error verifying JWT: " + err.Error())
 			http.Error(w, "Error verifying JWT: "+err.Error(), http.StatusUnauthorized)
@@ -70,8 +148,10 @@ func authenticationMiddleware(next http.Handler) http.Handler {
 		log.Println("verified JWT")
 
 		// Update headers with information from claims.
-		username := claims.(jwt.MapClaims)["username"].(string)
-		r.Header.Set("username", username)
+		r.Header.Set("username", claims.Username)
+		r.Header.Set("jti", claims.ID)
+		r.Header.Set("session", claims.Session)
+		r = r.WithContext(context.WithValue(r.Context(), claimsContextKey{}, claims))
 
 		log.Println("successfully passed through authentication middleware")
 
@@ -0,0 +1,120 @@
+// The broker that fans events out to the hubs of every replica of the server.
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// An event published through the broker. Exactly one field is set.
+type BrokerEvent struct {
+	// A frame to deliver to the clients it is for.
+	Message *BrokerMessage `bson:"message,omitempty"`
+
+	// A user joined or left a channel.
+	Membership *BrokerMembership `bson:"membership,omitempty"`
+
+	// IDs of revoked access tokens and sessions, whose clients must be
+	// disconnected.
+	Revoked []string `bson:"revoked,omitempty"`
+
+	// Username of a banned user, whose clients must be disconnected.
+	Disconnect string `bson:"disconnect,omitempty"`
+
+	// The presence of users on a replica.
+	Presence *BrokerPresence `bson:"presence,omitempty"`
+}
+
+// A broadcastMessage that can be sent to other replicas, which cannot target
+// a single client.
+type BrokerMessage struct {
+	Channel    string   `bson:"channel,omitempty"`
+	Recipients []string `bson:"recipients,omitempty"`
+	Thread     string   `bson:"thread,omitempty"`
+	Except     string   `bson:"except,omitempty"`
+	Stream     string   `bson:"stream,omitempty"`
+	Seq        int64    `bson:"seq,omitempty"`
+	Data       []byte   `bson:"data"`
+}
+
+// Convert the message back to a broadcastMessage.
+func (m BrokerMessage) broadcast() broadcastMessage {
+	return broadcastMessage{
+		channel:    m.Channel,
+		recipients: m.Recipients,
+		thread:     m.Thread,
+		except:     m.Except,
+		stream:     m.Stream,
+		seq:        m.Seq,
+		data:       m.Data,
+	}
+}
+
+// A user joining or leaving a channel, applying to every client of the user.
+type BrokerMembership struct {
+	Username string `bson:"username"`
+	Channel  string `bson:"channel"`
+	Joined   bool   `bson:"joined"`
+}
+
+// The presence of users on the replica that published it.
+type BrokerPresence struct {
+	// ID of the replica.
+	Replica string `bson:"replica"`
+
+	Users []ReplicaPresence `bson:"users"`
+}
+
+// Broker abstracts over how events reach the hub of every replica, so that a
+// single server can fan out in memory, and replicas can fan out through
+// MongoDB.
+type Broker interface {
+	// Publish an event to every subscriber of every replica, including this
+	// one.
+	Publish(ctx context.Context, event BrokerEvent) error
+
+	// Start receiving every event published after Subscribe returns, each
+	// exactly once. May only be called once.
+	Subscribe(ctx context.Context) (<-chan BrokerEvent, error)
+
+	// Release any resources held by the broker.
+	Close() error
+}
+
+// Create the broker selected by the configuration.
+func newBroker(ctx context.Context, config *Config) Broker {
+	switch config.BrokerBackend {
+	case "mongo":
+		log.Println("Using MongoDB broker.")
+		return newMongoBroker(ctx, config)
+	default:
+		return newMemoryBroker()
+	}
+}
+
+// A Broker that only reaches the hub of this process.
+type memoryBroker struct {
+	events chan BrokerEvent
+}
+
+// Create a new in-process broker.
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{events: make(chan BrokerEvent)}
+}
+
+func (m *memoryBroker) Publish(ctx context.Context, event BrokerEvent) error {
+	select {
+	case m.events <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *memoryBroker) Subscribe(ctx context.Context) (<-chan BrokerEvent, error) {
+	return m.events, nil
+}
+
+func (m *memoryBroker) Close() error {
+	return nil
+}
@@ -0,0 +1,164 @@
+// Routes for creating, listing, joining, and leaving channels.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Channel that every user belongs to and that messages are posted to by default.
+const defaultChannel = "general"
+
+// Valid channel names are short, lowercase, and URL-safe.
+var channelNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// Representation of a channel in the database and over the wire.
+type Channel struct {
+	Name    string    `bson:"_id" json:"name"`
+	Creator string    `bson:"creator" json:"creator"`
+	Created time.Time `bson:"created" json:"created"`
+
+	// Usernames of members. Empty for the default channel, which implicitly
+	// contains every user.
+	Members []string `bson:"members" json:"members"`
+}
+
+// Return whether the given user is a member of the channel.
+func (c Channel) hasMember(username string) bool {
+	if c.Name == defaultChannel {
+		return true
+	}
+	for _, member := range c.Members {
+		if member == username {
+			return true
+		}
+	}
+	return false
+}
+
+// Endpoint for listing all channels.
+func handleGetAllChannels(s *Server, w http.ResponseWriter, r *http.Request) {
+	channels, err := s.store.GetAllChannels(s.ctx)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, channels)
+}
+
+// Body of request to the create channel endpoint.
+type CreateChannelRequestBody struct {
+	Name string `json:"name"`
+}
+
+// Endpoint for creating a new channel. The creator automatically joins it.
+func handleCreateChannel(s *Server, w http.ResponseWriter, r *http.Request) {
+	var body CreateChannelRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !channelNamePattern.MatchString(body.Name) {
+		http.Error(w, "Channel names must be 1-32 lowercase letters, digits, dashes, or underscores.", http.StatusBadRequest)
+		return
+	}
+
+	username := r.Header.Get("username")
+	channel := Channel{
+		Name:    body.Name,
+		Creator: username,
+		Created: time.Now(),
+		Members: []string{username},
+	}
+	if err := s.store.CreateChannel(s.ctx, channel); err != nil {
+		if err == errAlreadyExists {
+			http.Error(w, "Channel already exists.", http.StatusConflict)
+			return
+		}
+
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.hub.publishMembership(username, channel.Name, true); err != nil {
+		log.Println(err)
+	}
+
+	log.Printf("%v created channel %v\n", username, channel.Name)
+	writeJSON(w, http.StatusCreated, channel)
+}
+
+// Endpoint for joining a channel.
+func handleJoinChannel(s *Server, w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	username := r.Header.Get("username")
+
+	if name != defaultChannel {
+		if err := s.store.AddChannelMember(s.ctx, name, username); err != nil {
+			if err == errNotFound {
+				http.Error(w, "No channel with given name.", http.StatusNotFound)
+				return
+			}
+
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := s.hub.publishMembership(username, name, true); err != nil {
+			log.Println(err)
+		}
+	}
+
+	log.Printf("%v joined channel %v\n", username, name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Endpoint for leaving a channel.
+func handleLeaveChannel(s *Server, w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	username := r.Header.Get("username")
+
+	if name == defaultChannel {
+		http.Error(w, "Cannot leave the default channel.", http.StatusBadRequest)
+		return
+	}
+	if err := s.store.RemoveChannelMember(s.ctx, name, username); err != nil {
+		if err == errNotFound {
+			http.Error(w, "No channel with given name.", http.StatusNotFound)
+			return
+		}
+
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.hub.publishMembership(username, name, false); err != nil {
+		log.Println(err)
+	}
+
+	log.Printf("%v left channel %v\n", username, name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Return a non-nil error unless the user belongs to the channel.
+func (s *Server) ensureChannelMember(name string, username string) error {
+	channel, err := s.store.GetChannel(s.ctx, name)
+	if err != nil {
+		if err == errNotFound {
+			return newAPIError(http.StatusNotFound, "No channel with given name.")
+		}
+		return err
+	}
+	if !channel.hasMember(username) {
+		return newAPIError(http.StatusForbidden, "Not a member of this channel.")
+	}
+
+	return nil
+}
@@ -3,28 +3,12 @@ package main
 import (
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-const (
-	// Delay between heartbeats in seconds.
-	heartbeatDelay = 25 * time.Second
-
-	// Time before client is considered unresponsive.
-	heartbeatTimeout = 30 * time.Second
-
-	// Time before a write is considered failed.
-	writeTimeout = 10 * time.Second
-
-	// Time allowed for user to send credentials for authentication setup.
-	authTimeout = 10 * time.Second
-
-	// Maximum message size allowed from client.
-	maxMessageSize = 512
-)
-
 var upgrader = websocket.Upgrader{
 	CheckOrigin:     func(r *http.Request) bool { return true },
 	ReadBufferSize:  1024,
@@ -36,27 +20,91 @@ type Client struct {
 	// The hub responsible for the client.
 	hub *Hub
 
+	// The server, used to handle inbound frames.
+	server *Server
+
 	// The websocket connection.
 	conn *websocket.Conn
 
-	// Buffered channel of outbound messages.
-	send chan []byte
+	// The username the connection authenticated as.
+	username string
+
+	// The IP address the connection came from.
+	ip string
+
+	// Channels the user has joined. Owned by the hub goroutine.
+	channels map[string]bool
+
+	// IDs of the parent messages of threads the client is viewing. Owned by the
+	// hub goroutine.
+	threads map[string]bool
+
+	// Bounded queue of outbound messages.
+	send *sendQueue
+
+	// Sequence number of the last event the client received in each stream
+	// it asked to resume.
+	resume map[string]int64
+
+	// Frames to send before any from the send queue, catching the client up
+	// on the streams it resumed. Owned by the write goroutine once it starts.
+	replay [][]byte
+
+	// Sequence number of the last event replayed in each stream. Queued
+	// events up to it were already replayed and are skipped. Owned by the
+	// write goroutine once it starts.
+	replayed map[string]int64
+
+	// When the user last interacted with this connection. Owned by the hub
+	// goroutine.
+	lastActive time.Time
+
+	// When the access token the connection authenticated with expires. Owned
+	// by the write goroutine once it starts.
+	expires time.Time
+
+	// Expiry times of access tokens the client re-authenticated with.
+	reauthenticated chan time.Time
+
+	// Guards token.
+	tokenMu sync.Mutex
+
+	// Claims of the access token the connection last authenticated with.
+	token AccessClaims
+}
+
+// Record the access token the connection authenticated with.
+func (c *Client) setToken(claims AccessClaims) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	c.token = claims
+}
+
+// Return whether the connection authenticated with one of the given token or
+// session IDs.
+func (c *Client) hasToken(ids map[string]bool) bool {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	return ids[c.token.ID] || ids[c.token.Session]
 }
 
 // Continuously reads messages from the websocket.
 func (c *Client) read() {
 	defer func() {
-		c.hub.unregister <- c
+		c.hub.unregisterClient(c)
 		c.conn.WriteMessage(websocket.CloseMessage, nil)
 		c.conn.Close()
+		c.hub.connections.Done()
 	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadLimit(c.server.config.MaxMessageSize)
 
 	// Handle heartbeats.
-	c.conn.SetReadDeadline(time.Now().Add(heartbeatTimeout))
+	c.conn.SetReadDeadline(time.Now().Add(c.server.config.HeartbeatTimeout))
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(heartbeatTimeout))
+		c.conn.SetReadDeadline(time.Now().Add(c.server.config.HeartbeatTimeout))
 		return nil
 	})
 
@@ -66,48 +114,74 @@ func (c *Client) read() {
 			log.Println(err)
 			return
 		}
-		c.hub.broadcast <- message
+		c.hub.touch(c)
+		c.handleFrame(message)
 	}
 }
 
 // Continuously writes messages from the send queue to the websocket.
 func (c *Client) write() {
-	ticker := time.NewTicker(heartbeatDelay)
+	ticker := time.NewTicker(c.server.config.HeartbeatInterval)
+	expiry := time.NewTimer(time.Until(c.expires))
 	defer func() {
 		ticker.Stop()
+		expiry.Stop()
 		c.conn.WriteMessage(websocket.CloseMessage, nil)
 		c.conn.Close()
+		c.hub.connections.Done()
 	}()
 
+	for _, message := range c.replay {
+		if err := c.writeText(message); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	c.replay = nil
+
 	for {
 		select {
-		case message, ok := <-c.send:
-			// If hub closed channel, close connection.
-			if !ok {
-				return
+		case <-c.send.ready:
+			frames, gap, closed := c.send.take()
+			if gap.Dropped > 0 {
+				if serialized, err := newEnvelope(eventGap, gap); err != nil {
+					log.Println(err)
+				} else if err := c.writeText(serialized); err != nil {
+					log.Println(err)
+					return
+				}
 			}
-
-			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			w.Write(message)
-
-			// Add any remaining messages from queue.
-			for len(c.send) > 0 {
-				w.Write([]byte{'\n'})
-				w.Write(<-c.send)
+			for _, frame := range frames {
+				if frame.seq != 0 && frame.seq <= c.replayed[frame.stream] {
+					continue
+				}
+				if err := c.writeText(frame.data); err != nil {
+					log.Println(err)
+					return
+				}
 			}
 
-			if err := w.Close(); err != nil {
-				log.Println(err)
+			// If hub closed the queue, close connection.
+			if closed {
+				code, reason := c.send.closeMessage()
+				c.conn.SetWriteDeadline(time.Now().Add(c.server.config.WriteTimeout))
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
 				return
 			}
+		case expires := <-c.reauthenticated:
+			if !expiry.Stop() {
+				<-expiry.C
+			}
+			c.expires = expires
+			expiry.Reset(time.Until(expires))
+		case <-expiry.C:
+			// The client did not re-authenticate in time.
+			log.Printf("Access token of %v expired, closing connection.\n", c.username)
+			c.conn.SetWriteDeadline(time.Now().Add(c.server.config.WriteTimeout))
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "access token expired"))
+			return
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			c.conn.SetWriteDeadline(time.Now().Add(c.server.config.WriteTimeout))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				log.Println(err)
 				return
@@ -117,35 +191,66 @@ func (c *Client) write() {
 
 }
 
-// Returns a non-nil error if a non-authenticated user tries to establish a websocket connection.
+// Write an envelope in its own frame.
+func (c *Client) writeText(data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.server.config.WriteTimeout))
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// Returns a non-nil error if a non-authenticated user tries to establish a
+// websocket connection. Otherwise, records the username the client
+// authenticated as, and the streams it asked to resume.
 func (c *Client) ensureAuthenticated() error {
 	log.Println("Waiting for authentication message from client.")
-	c.conn.SetReadDeadline(time.Now().Add(authTimeout))
-	_, signedString, err := c.conn.ReadMessage()
+	c.conn.SetReadDeadline(time.Now().Add(c.server.config.AuthTimeout))
+	_, data, err := c.conn.ReadMessage()
 	if err != nil {
 		log.Println("Did not receive valid credentials before timeout.")
 		return err
 	}
-	log.Printf("Got the following JWT, attempting to verify: %v\n", signedString)
-	_, err = verifyJWTToken(string(signedString))
-
-	return err
+	message, err := parseAuthenticationMessage(data)
+	if err != nil {
+		return err
+	}
+	log.Println("Got a JWT, attempting to verify it.")
+	claims, err := c.server.verifyAccessToken(message.Token)
+	if err != nil {
+		return err
+	}
+	c.username, c.expires = claims.Username, claims.Expires
+	c.resume = message.Resume
+	c.setToken(claims)
 
+	return nil
 }
 
 // Handles the creation of a Client when receiving an incoming websocket connection.
-func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+func serveWs(s *Server, w http.ResponseWriter, r *http.Request) {
 	log.Printf("Incoming websocket connection from %v\n", r.RemoteAddr)
 
+	// Clients connecting during shutdown should reach another replica.
+	select {
+	case <-s.stopping:
+		http.Error(w, "Server is shutting down.", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	client := &Client{
-		hub:  hub,
-		conn: conn,
-		send: make(chan []byte, 16),
+		hub:      s.hub,
+		server:   s,
+		conn:     conn,
+		ip:       s.requestIP(r),
+		channels: map[string]bool{defaultChannel: true},
+		threads:  map[string]bool{},
+		send:     newSendQueue(s.hub.config.QueueSize),
+
+		reauthenticated: make(chan time.Time, 1),
 	}
 
 	if err := client.ensureAuthenticated(); err != nil {
@@ -154,7 +259,47 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hub.register <- client
+	// Subscribe to the channels the user has joined.
+	joined, err := s.store.GetUserChannels(s.ctx, client.username)
+	if err != nil {
+		log.Println(err)
+		conn.Close()
+		return
+	}
+	for _, name := range joined {
+		client.channels[name] = true
+	}
+
+	streams, rejections := s.authorizeResume(client)
+
+	if !s.hub.registerClient(client) {
+		// The server started shutting down since the connection was accepted.
+		conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, reconnectReason))
+		conn.Close()
+		return
+	}
+
+	// Replay the events the client missed in the streams it resumed. Events
+	// published from here on are queued, and skipped if already replayed.
+	replay, replayed, err := s.loadReplay(streams)
+	if err != nil {
+		log.Println(err)
+		s.hub.unregisterClient(client)
+		s.hub.connections.Add(-2)
+		conn.Close()
+		return
+	}
+	client.replay, client.replayed = append(rejections, replay...), replayed
+
+	// Catch the client up on what the user missed while offline.
+	if counts, err := s.getAllUnreadCounts(client.username); err != nil {
+		log.Println(err)
+	} else if serialized, err := newEnvelope(eventUnreadCounts, counts); err != nil {
+		log.Println(err)
+	} else {
+		s.hub.send(broadcastMessage{client: client, data: serialized})
+	}
 
 	// Start reading from and writing to websocket.
 	log.Println("Now reading from and writing to websocket.")
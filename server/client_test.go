@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Create a websocket connection, and return its server end and its client
+// end.
+func newTestConn(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		peer.Close()
+	})
+
+	return <-conns, peer
+}
+
+// Run the write goroutine of a client of the server on a new connection, and
+// return the client end of the connection. queue, if set, fills the client's
+// queue before the goroutine starts.
+func startTestWriter(t *testing.T, s *Server, client *Client, queue func()) *websocket.Conn {
+	t.Helper()
+
+	conn, peer := newTestConn(t)
+	client.server, client.conn = s, conn
+	client.expires = time.Now().Add(time.Hour)
+	if queue != nil {
+		queue()
+	}
+	s.hub.connections.Add(1)
+	go client.write()
+
+	return peer
+}
+
+// Read text frames from a connection until it closes, and return their
+// envelopes and the close code.
+func readUntilClosed(t *testing.T, peer *websocket.Conn) ([]Envelope, int) {
+	t.Helper()
+
+	var envelopes []Envelope
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := peer.ReadMessage()
+		if err != nil {
+			closeErr, ok := err.(*websocket.CloseError)
+			if !ok {
+				t.Fatal(err)
+			}
+			return envelopes, closeErr.Code
+		}
+		var envelope Envelope
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			t.Fatal(err)
+		}
+		envelopes = append(envelopes, envelope)
+	}
+}
+
+// Events queued while the client was being caught up must not be sent again
+// if they were replayed.
+func TestWriteSkipsReplayedEvents(t *testing.T) {
+	s := newTestServer(t, nil)
+	stream := Target{Channel: defaultChannel}.stream()
+	frame := func(seq int64) []byte {
+		data, err := newStreamEnvelope(eventResync, ResyncPayload{}, stream, seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	client := newTestClient(s.hub, "alice")
+	client.replay, client.replayed = [][]byte{frame(1), frame(2)}, map[string]int64{stream: 2}
+	peer := startTestWriter(t, s, client, func() {
+		for seq := int64(2); seq <= 3; seq++ {
+			client.send.push(outboundFrame{stream: stream, seq: seq, data: frame(seq)})
+		}
+		client.send.close(websocket.CloseNormalClosure, "")
+	})
+
+	envelopes, code := readUntilClosed(t, peer)
+	var seqs []int64
+	for _, envelope := range envelopes {
+		seqs = append(seqs, envelope.Seq)
+	}
+	if len(seqs) != 3 || seqs[0] != 1 || seqs[1] != 2 || seqs[2] != 3 {
+		t.Errorf("got events %v, want 1, 2, and 3", seqs)
+	}
+	if code != websocket.CloseNormalClosure {
+		t.Errorf("got close code %v, want %v", code, websocket.CloseNormalClosure)
+	}
+}
@@ -0,0 +1,435 @@
+// The configuration of every subsystem, loaded from a file, the environment,
+// and flags.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Config holds every setting of the server. Each setting is also a flag, and
+// can be given in the configuration file under the flag's name, or in the
+// environment variable named by upper-casing the flag's name and replacing
+// dashes with underscores, unless envNames says otherwise. Flags take
+// precedence over the environment, which takes precedence over the file.
+type Config struct {
+	// Address the HTTP server listens on.
+	Addr string
+
+	// Origin allowed to make cross-origin requests.
+	CORSOrigin string
+
+	// Header, such as X-Forwarded-For or X-Real-IP, in which the reverse
+	// proxy in front of the server gives the address of clients. Clients can
+	// forge it, so it must only be set if every request comes through a proxy
+	// that sets or appends to it.
+	TrustedProxyHeader string
+
+	// How long shutdown waits for requests, connections, and background tasks
+	// to finish before giving up on them.
+	ShutdownTimeout time.Duration
+
+	// Where users and messages are stored: mongo or memory.
+	StorageBackend string
+
+	// How websocket events reach every replica: memory or mongo.
+	BrokerBackend string
+
+	// Connection string, database, and credentials of MongoDB.
+	MongoURI      string
+	MongoDatabase string
+	MongoUsername string
+	MongoPassword string
+
+	// Keys for signing and verifying access tokens, as described in newKeyring.
+	JWTKeysDir      string
+	JWTSigningKeyID string
+	JWTSigningKey   string
+
+	// Users who are granted roleAdmin.
+	AdminUsernames []string
+
+	// Cost of the bcrypt hashes of passwords.
+	BcryptCost int
+
+	// How long access tokens, and refresh tokens since login, are valid.
+	// Rotating a refresh token does not extend the lifetime of its family.
+	AccessTokenLifetime  time.Duration
+	RefreshTokenLifetime time.Duration
+
+	// Delay between heartbeats sent to websocket clients, and how long a
+	// client may stay silent before it is considered unresponsive.
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+
+	// Time before a websocket write is considered failed.
+	WriteTimeout time.Duration
+
+	// Time allowed for websocket clients to send credentials.
+	AuthTimeout time.Duration
+
+	// Maximum size in bytes of frames from websocket clients.
+	MaxMessageSize int64
+
+	// Time without activity on any connection before a user is idle.
+	IdleTimeout time.Duration
+
+	// Time after the last typing frame before a user is considered to have
+	// stopped typing.
+	TypingTimeout time.Duration
+
+	// How long sequenced events are kept for replay, and the maximum number
+	// replayed per stream before clients have to resync.
+	ReplayRetention time.Duration
+	MaxReplayEvents int
+
+	// Number of messages in a page if the client does not specify a limit,
+	// and the maximum it may ask for.
+	DefaultPageSize int
+	MaxPageSize     int
+
+	// Sizes of the queues between publishers, the hub, and clients.
+	Fanout fanoutConfig
+
+	// Limits of each class of requests.
+	RateLimits map[rateLimitClass]classLimits
+
+	// How long tombstones of deleted messages are kept before being purged.
+	TombstoneRetention time.Duration
+}
+
+// Create a configuration holding the default of every setting.
+func defaultConfig() *Config {
+	limits := map[rateLimitClass]classLimits{}
+	for class, classDefaults := range defaultRateLimits {
+		limits[class] = classDefaults
+	}
+
+	return &Config{
+		Addr:            "0.0.0.0:8000",
+		CORSOrigin:      "http://localhost:3000",
+		ShutdownTimeout: 20 * time.Second,
+
+		StorageBackend: "mongo",
+		BrokerBackend:  "memory",
+
+		MongoURI:      "mongodb://db-service:27017/admin",
+		MongoDatabase: "admin",
+
+		BcryptCost:           12,
+		AccessTokenLifetime:  15 * time.Minute,
+		RefreshTokenLifetime: 30 * 24 * time.Hour,
+
+		HeartbeatInterval: 25 * time.Second,
+		HeartbeatTimeout:  30 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		AuthTimeout:       10 * time.Second,
+		MaxMessageSize:    4096,
+
+		IdleTimeout:     5 * time.Minute,
+		TypingTimeout:   5 * time.Second,
+		ReplayRetention: time.Hour,
+		MaxReplayEvents: 1000,
+		DefaultPageSize: 50,
+		MaxPageSize:     200,
+
+		Fanout:             defaultFanoutConfig,
+		RateLimits:         limits,
+		TombstoneRetention: 24 * time.Hour,
+	}
+}
+
+// Environment variables of the settings whose names do not follow from their
+// flags.
+var envNames = map[string]string{
+	"mongo-username": "MONGO_INITDB_ROOT_USERNAME",
+	"mongo-password": "MONGO_INITDB_ROOT_PASSWORD",
+}
+
+// Settings whose values are not printed.
+var secretSettings = map[string]bool{
+	"mongo-password":  true,
+	"jwt-signing-key": true,
+}
+
+// Return the environment variable of a setting.
+func envName(setting string) string {
+	if name, ok := envNames[setting]; ok {
+		return name
+	}
+	return strings.ToUpper(strings.ReplaceAll(setting, "-", "_"))
+}
+
+// Create a flag set defining a flag for every setting, bound to c.
+func (c *Config) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+
+	fs.StringVar(&c.Addr, "addr", c.Addr, "address the HTTP server listens on")
+	fs.StringVar(&c.CORSOrigin, "cors-origin", c.CORSOrigin, "origin allowed to make cross-origin requests")
+	fs.StringVar(&c.TrustedProxyHeader, "trusted-proxy-header", c.TrustedProxyHeader, "header in which the reverse proxy gives the address of clients, such as X-Forwarded-For")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long shutdown waits for requests and connections")
+
+	fs.StringVar(&c.StorageBackend, "storage-backend", c.StorageBackend, "where users and messages are stored: mongo or memory")
+	fs.StringVar(&c.BrokerBackend, "broker-backend", c.BrokerBackend, "how websocket events reach every replica: memory or mongo")
+
+	fs.StringVar(&c.MongoURI, "mongo-uri", c.MongoURI, "MongoDB connection string")
+	fs.StringVar(&c.MongoDatabase, "mongo-database", c.MongoDatabase, "MongoDB database")
+	fs.StringVar(&c.MongoUsername, "mongo-username", c.MongoUsername, "MongoDB username")
+	fs.StringVar(&c.MongoPassword, "mongo-password", c.MongoPassword, "MongoDB password")
+
+	fs.StringVar(&c.JWTKeysDir, "jwt-keys-dir", c.JWTKeysDir, "directory of keys for signing and verifying access tokens")
+	fs.StringVar(&c.JWTSigningKeyID, "jwt-signing-key-id", c.JWTSigningKeyID, "ID of the key in jwt-keys-dir that signs new tokens")
+	fs.StringVar(&c.JWTSigningKey, "jwt-signing-key", c.JWTSigningKey, "HMAC secret that signs tokens if jwt-keys-dir is not set")
+
+	fs.Var((*listValue)(&c.AdminUsernames), "admin-usernames", "comma-separated usernames granted the admin role")
+	fs.IntVar(&c.BcryptCost, "bcrypt-cost", c.BcryptCost, "cost of the bcrypt hashes of passwords")
+	fs.DurationVar(&c.AccessTokenLifetime, "access-token-lifetime", c.AccessTokenLifetime, "how long access tokens are valid")
+	fs.DurationVar(&c.RefreshTokenLifetime, "refresh-token-lifetime", c.RefreshTokenLifetime, "how long refresh tokens are valid after login")
+
+	fs.DurationVar(&c.HeartbeatInterval, "heartbeat-interval", c.HeartbeatInterval, "delay between heartbeats sent to websocket clients")
+	fs.DurationVar(&c.HeartbeatTimeout, "heartbeat-timeout", c.HeartbeatTimeout, "time before a silent websocket client is considered unresponsive")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "time before a websocket write is considered failed")
+	fs.DurationVar(&c.AuthTimeout, "auth-timeout", c.AuthTimeout, "time allowed for websocket clients to send credentials")
+	fs.Int64Var(&c.MaxMessageSize, "max-message-size", c.MaxMessageSize, "maximum size in bytes of frames from websocket clients")
+
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "time without activity before a user is idle")
+	fs.DurationVar(&c.TypingTimeout, "typing-timeout", c.TypingTimeout, "time after the last typing frame before a user stops typing")
+	fs.DurationVar(&c.ReplayRetention, "replay-retention", c.ReplayRetention, "how long sequenced events are kept for replay")
+	fs.IntVar(&c.MaxReplayEvents, "max-replay-events", c.MaxReplayEvents, "maximum number of events replayed per stream")
+	fs.IntVar(&c.DefaultPageSize, "default-page-size", c.DefaultPageSize, "number of items in a page if the client does not specify a limit")
+	fs.IntVar(&c.MaxPageSize, "max-page-size", c.MaxPageSize, "maximum number of items in a page")
+
+	fs.IntVar(&c.Fanout.QueueSize, "ws-queue-size", c.Fanout.QueueSize, "maximum number of frames queued for each websocket connection")
+	fs.Var(&c.Fanout.Overflow, "ws-overflow-policy", "what to do when a connection's queue is full: drop_oldest or disconnect")
+	fs.IntVar(&c.Fanout.PublishQueueSize, "publish-queue-size", c.Fanout.PublishQueueSize, "maximum number of events waiting to be published")
+
+	for _, class := range []rateLimitClass{limitAuth, limitMessages, limitVotes, limitFrames} {
+		for _, scope := range []string{"user", "ip"} {
+			name := "rate-limit-" + string(class) + "-" + scope
+			fs.Var(rateLimitValue{limits: c.RateLimits, class: class, scope: scope}, name, "rate limit of "+string(class)+" requests per "+scope+", as <burst>/<period> or off")
+		}
+	}
+
+	fs.DurationVar(&c.TombstoneRetention, "tombstone-retention", c.TombstoneRetention, "how long deleted messages are kept as tombstones")
+
+	return fs
+}
+
+// Load the configuration from the file named by the --config flag or the
+// CONFIG_FILE environment variable, the environment, and the flags in args,
+// and validate it. Also returns whether --print-config was given.
+func loadConfig(args []string) (*Config, bool, error) {
+	c := defaultConfig()
+	fs := c.flags()
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "JSON file mapping setting names to values")
+	printConfig := fs.Bool("print-config", false, "print the effective configuration, with secrets redacted, and exit")
+
+	// Find the file first, then apply the flags again over the file and the
+	// environment.
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+	if *path != "" {
+		if err := c.loadFile(fs, *path); err != nil {
+			return nil, false, err
+		}
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" || err != nil {
+			return
+		}
+		if value := os.Getenv(envName(f.Name)); value != "" {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid %v: %w", envName(f.Name), setErr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	return c, *printConfig, c.validate()
+}
+
+// Apply the settings in a configuration file, a JSON object mapping setting
+// names to strings, numbers, or booleans.
+func (c *Config) loadFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var settings map[string]json.RawMessage
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("%v: %w", path, err)
+	}
+
+	for name, raw := range settings {
+		value := string(raw)
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			value = s
+		}
+		if name == "config" || name == "print-config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("%v: unknown setting %v", path, name)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%v: invalid %v: %w", path, name, err)
+		}
+	}
+
+	return nil
+}
+
+// Return an error describing every invalid setting.
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Addr != "", "addr is required")
+	check(c.CORSOrigin != "", "cors-origin is required")
+	check(c.ShutdownTimeout > 0, "shutdown-timeout must be positive")
+
+	check(c.StorageBackend == "mongo" || c.StorageBackend == "memory", "unknown storage backend: %v", c.StorageBackend)
+	check(c.BrokerBackend == "memory" || c.BrokerBackend == "mongo", "unknown broker backend: %v", c.BrokerBackend)
+	if c.StorageBackend == "mongo" || c.BrokerBackend == "mongo" {
+		check(c.MongoURI != "", "mongo-uri is required")
+		check(c.MongoDatabase != "", "mongo-database is required")
+		check(c.MongoUsername != "", "mongo-username is required")
+		check(c.MongoPassword != "", "mongo-password is required")
+	}
+
+	// A random key generated at startup only works with a single replica, and
+	// tokens stop being valid when it restarts, which is only acceptable
+	// when state is lost anyway.
+	check(c.JWTKeysDir != "" || c.JWTSigningKey != "" || (c.StorageBackend == "memory" && c.BrokerBackend == "memory"),
+		"jwt-keys-dir or jwt-signing-key is required unless both backends are memory")
+
+	check(c.BcryptCost >= bcrypt.MinCost && c.BcryptCost <= bcrypt.MaxCost, "bcrypt-cost must be between %v and %v", bcrypt.MinCost, bcrypt.MaxCost)
+	check(c.AccessTokenLifetime > 0, "access-token-lifetime must be positive")
+	check(c.RefreshTokenLifetime > c.AccessTokenLifetime, "refresh-token-lifetime must be longer than access-token-lifetime")
+
+	check(c.HeartbeatInterval > 0, "heartbeat-interval must be positive")
+	check(c.HeartbeatTimeout > c.HeartbeatInterval, "heartbeat-timeout must be longer than heartbeat-interval")
+	check(c.WriteTimeout > 0, "write-timeout must be positive")
+	check(c.AuthTimeout > 0, "auth-timeout must be positive")
+	check(c.MaxMessageSize > 0, "max-message-size must be positive")
+
+	check(c.IdleTimeout > 0, "idle-timeout must be positive")
+	check(c.TypingTimeout > 0, "typing-timeout must be positive")
+	check(c.ReplayRetention >= time.Second, "replay-retention must be at least 1s")
+	check(c.MaxReplayEvents > 0, "max-replay-events must be positive")
+	check(c.MaxPageSize > 0, "max-page-size must be positive")
+	check(c.DefaultPageSize > 0 && c.DefaultPageSize <= c.MaxPageSize, "default-page-size must be between 1 and max-page-size")
+
+	check(c.Fanout.QueueSize > 0, "ws-queue-size must be positive")
+	check(c.Fanout.PublishQueueSize > 0, "publish-queue-size must be positive")
+	check(c.TombstoneRetention >= 0, "tombstone-retention must not be negative")
+
+	return errors.Join(errs...)
+}
+
+// Write the effective configuration as a JSON object that can be loaded as a
+// configuration file, with the values of secrets redacted.
+func (c *Config) print(w io.Writer) error {
+	settings := map[string]string{}
+	c.flags().VisitAll(func(f *flag.Flag) {
+		settings[f.Name] = redact(f.Name, f.Value.String())
+	})
+
+	serialized, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(serialized))
+	return err
+}
+
+// Hide the value of a setting if it is or contains a secret.
+func redact(name string, value string) string {
+	if value == "" {
+		return value
+	}
+	if secretSettings[name] {
+		return "REDACTED"
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "REDACTED")
+			return u.String()
+		}
+	}
+
+	return value
+}
+
+// A flag.Value of a comma-separated list.
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// A flag.Value of the limit of a class of requests per user or per IP
+// address.
+type rateLimitValue struct {
+	limits map[rateLimitClass]classLimits
+	class  rateLimitClass
+	scope  string
+}
+
+func (v rateLimitValue) String() string {
+	if v.limits == nil {
+		return ""
+	}
+	limits := v.limits[v.class]
+	if v.scope == "user" {
+		return limits.User.String()
+	}
+	return limits.IP.String()
+}
+
+func (v rateLimitValue) Set(value string) error {
+	limit, err := parseRateLimit(value)
+	if err != nil {
+		return err
+	}
+	limits := v.limits[v.class]
+	if v.scope == "user" {
+		limits.User = limit
+	} else {
+		limits.IP = limit
+	}
+	v.limits[v.class] = limits
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write a configuration file holding the given settings, and return its path.
+func writeConfigFile(t *testing.T, settings string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(settings), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Flags take precedence over the environment, which takes precedence over
+// the file.
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"storage-backend": "memory",
+		"addr": "file:1",
+		"cors-origin": "http://file",
+		"typing-timeout": "3s",
+		"max-page-size": 100,
+		"mongo-username": "file-user"
+	}`)
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("ADDR", "env:1")
+	t.Setenv("CORS_ORIGIN", "http://env")
+	t.Setenv("MONGO_INITDB_ROOT_USERNAME", "env-user")
+
+	c, printConfig, err := loadConfig([]string{"--addr", "flag:1", "--print-config"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !printConfig {
+		t.Error("--print-config was not reported")
+	}
+	if c.Addr != "flag:1" || c.CORSOrigin != "http://env" || c.TypingTimeout != 3*time.Second || c.MaxPageSize != 100 {
+		t.Errorf("got addr %v, cors-origin %v, typing-timeout %v, max-page-size %v", c.Addr, c.CORSOrigin, c.TypingTimeout, c.MaxPageSize)
+	}
+	if c.MongoUsername != "env-user" {
+		t.Errorf("got mongo-username %v, want it from MONGO_INITDB_ROOT_USERNAME", c.MongoUsername)
+	}
+
+	// The flag names a file that takes the place of CONFIG_FILE.
+	other := writeConfigFile(t, `{"storage-backend": "memory", "default-page-size": 7}`)
+	c, _, err = loadConfig([]string{"--config", other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DefaultPageSize != 7 || c.MaxPageSize != defaultConfig().MaxPageSize {
+		t.Errorf("got default-page-size %v and max-page-size %v from --config", c.DefaultPageSize, c.MaxPageSize)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, test := range []struct {
+		settings string
+		env      map[string]string
+		want     string
+	}{
+		{settings: `{"storage-backend": "memory", "no-such-setting": 1}`, want: "unknown setting no-such-setting"},
+		{settings: `{"storage-backend": "memory", "typing-timeout": "soon"}`, want: "invalid typing-timeout"},
+		{settings: `{"storage-backend": "memory"}`, env: map[string]string{"BCRYPT_COST": "many"}, want: "invalid BCRYPT_COST"},
+		{settings: `{"storage-backend": "memory", "default-page-size": 500}`, want: "default-page-size must be between"},
+		{settings: `[]`, want: "cannot unmarshal"},
+	} {
+		t.Run(test.want, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			_, _, err := loadConfig([]string{"--config", writeConfigFile(t, test.settings)})
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+// The printed configuration hides secrets, and can be loaded as a
+// configuration file.
+func TestPrintConfigRedactsSecrets(t *testing.T) {
+	c := defaultConfig()
+	c.StorageBackend = "memory"
+	c.MongoPassword = "mongo-secret"
+	c.JWTSigningKey = strings.Repeat("jwt-secret", 4)
+	c.MongoURI = "mongodb://user:uri-secret@db:27017/admin"
+	c.MaxPageSize = 123
+
+	var buf bytes.Buffer
+	if err := c.print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"mongo-secret", "jwt-secret", "uri-secret"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("printed configuration contains %v:\n%v", secret, buf.String())
+		}
+	}
+	var settings map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &settings); err != nil {
+		t.Fatal(err)
+	}
+	if settings["mongo-password"] != "REDACTED" || settings["mongo-uri"] != "mongodb://user:REDACTED@db:27017/admin" {
+		t.Errorf("got mongo-password %v and mongo-uri %v", settings["mongo-password"], settings["mongo-uri"])
+	}
+	if settings["mongo-username"] != "" {
+		t.Errorf("unset setting printed as %q", settings["mongo-username"])
+	}
+
+	loaded, _, err := loadConfig([]string{"--config", writeConfigFile(t, buf.String())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.MaxPageSize != 123 || loaded.RateLimits[limitAuth] != c.RateLimits[limitAuth] {
+		t.Errorf("printed configuration loaded with max-page-size %v and auth limits %+v", loaded.MaxPageSize, loaded.RateLimits[limitAuth])
+	}
+}
+
+// Without a configured signing key, every replica would sign tokens with a
+// random key of its own, so one is required unless both backends are memory.
+func TestValidateRequiresSigningKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(c *Config)
+		ok        bool
+	}{
+		{name: "memory backends", configure: func(c *Config) { c.StorageBackend = "memory" }, ok: true},
+		{name: "mongo storage", configure: func(c *Config) {}, ok: false},
+		{name: "mongo broker", configure: func(c *Config) { c.StorageBackend, c.BrokerBackend = "memory", "mongo" }, ok: false},
+		{name: "secret", configure: func(c *Config) { c.JWTSigningKey = strings.Repeat("s", minSecretLength) }, ok: true},
+		{name: "keys directory", configure: func(c *Config) { c.JWTKeysDir = "keys" }, ok: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := defaultConfig()
+			c.MongoUsername, c.MongoPassword = "user", "password"
+			test.configure(c)
+
+			err := c.validate()
+			if got := err == nil || !strings.Contains(err.Error(), "jwt-keys-dir or jwt-signing-key"); got != test.ok {
+				t.Errorf("got error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+// Routes for direct message conversations between users.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Maximum number of participants in a direct message conversation.
+const maxConversationParticipants = 8
+
+// Representation of a direct message conversation in the database and over
+// the wire.
+type Conversation struct {
+	ID string `bson:"_id,omitempty" json:"id"`
+
+	// Uniquely identifies the set of participants, so that there is at most
+	// one conversation between the same group of users.
+	Key string `bson:"key" json:"-"`
+
+	// Sorted usernames of the participants.
+	Participants []string `bson:"participants" json:"participants"`
+
+	Created time.Time `bson:"created" json:"created"`
+}
+
+// Return whether the given user is a participant in the conversation.
+func (c Conversation) hasParticipant(username string) bool {
+	for _, participant := range c.Participants {
+		if participant == username {
+			return true
+		}
+	}
+	return false
+}
+
+// Deduplicate and sort participants, and compute the key identifying them.
+func normalizeParticipants(usernames []string) ([]string, string) {
+	set := map[string]struct{}{}
+	for _, username := range usernames {
+		set[username] = struct{}{}
+	}
+	participants := make([]string, 0, len(set))
+	for username := range set {
+		participants = append(participants, username)
+	}
+	sort.Strings(participants)
+
+	// Usernames are JSON encoded so that the separator cannot be ambiguous.
+	encoded, _ := json.Marshal(participants)
+	return participants, string(encoded)
+}
+
+// Endpoint for listing the conversations the user participates in.
+func handleGetAllConversations(s *Server, w http.ResponseWriter, r *http.Request) {
+	conversations, err := s.store.GetUserConversations(s.ctx, r.Header.Get("username"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, conversations)
+}
+
+// Body of request to the create conversation endpoint.
+type CreateConversationRequestBody struct {
+	// Usernames of the other participants.
+	Participants []string `json:"participants"`
+}
+
+// Endpoint for starting a conversation. If a conversation between the same
+// participants already exists, it is returned instead.
+func handleCreateConversation(s *Server, w http.ResponseWriter, r *http.Request) {
+	var body CreateConversationRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	username := r.Header.Get("username")
+	participants, key := normalizeParticipants(append(body.Participants, username))
+	if len(participants) < 2 {
+		http.Error(w, "A conversation needs at least one other participant.", http.StatusBadRequest)
+		return
+	}
+	if len(participants) > maxConversationParticipants {
+		http.Error(w, "Too many participants.", http.StatusBadRequest)
+		return
+	}
+	for _, participant := range participants {
+		exists, err := s.userExists(participant)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "No account with username "+participant+".", http.StatusBadRequest)
+			return
+		}
+	}
+
+	conversation, err := s.store.GetOrCreateConversation(s.ctx, Conversation{
+		Key:          key,
+		Participants: participants,
+		Created:      time.Now(),
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("%v started conversation with %v\n", username, strings.Join(participants, ", "))
+	writeJSON(w, http.StatusOK, conversation)
+}
+
+// Endpoint for getting a page of messages in a conversation.
+func handleGetConversationMessages(s *Server, w http.ResponseWriter, r *http.Request) {
+	query := MessageQuery{Target: Target{Conversation: mux.Vars(r)["id"]}}
+	log.Printf("Getting messages in conversation %v.\n", query.Conversation)
+
+	if _, err := s.ensureConversationParticipant(query.Conversation, r.Header.Get("username")); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.parsePageParameters(r, &query); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	page, err := s.getMessagePage(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.addUnreadCount(&page, r.Header.Get("username"), query.Target); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// Return the conversation, or a non-nil error unless the user participates in
+// it.
+func (s *Server) ensureConversationParticipant(id string, username string) (Conversation, error) {
+	conversation, err := s.store.GetConversation(s.ctx, id)
+	if err != nil {
+		if err == errNotFound {
+			return Conversation{}, newAPIError(http.StatusNotFound, "No conversation with given ID.")
+		}
+		return Conversation{}, err
+	}
+	if !conversation.hasParticipant(username) {
+		// Don't reveal that the conversation exists.
+		return Conversation{}, newAPIError(http.StatusNotFound, "No conversation with given ID.")
+	}
+
+	return conversation, nil
+}
@@ -0,0 +1,88 @@
+// Routes for deleting messages, and purging deleted messages in the background.
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Maximum delay between purges of expired tombstones.
+const maxPurgeInterval = 10 * time.Minute
+
+// Endpoint for deleting a message. Only the author and moderators may delete
+// a message, and deletions by moderators are removals, as with
+// handleRemoveMessage. The message is replaced by a tombstone so that history
+// and votes stay consistent, and is purged later.
+func handleDeleteMessage(s *Server, w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	username := r.Header.Get("username")
+	log.Printf("Deleting message with ID: %v\n", id)
+
+	message, err := s.getLiveMessage(id, username)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if message.Author != username {
+		if err := s.ensurePermission(requestClaims(r), permModerate); err != nil {
+			writeError(w, err)
+			return
+		}
+		handleRemoveMessage(s, w, r)
+		return
+	}
+
+	message, err = s.store.DeleteMessage(s.ctx, id, username, time.Now())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.broadcastEvent(message, eventMessageDeleted, message); err != nil {
+		log.Println(err)
+	}
+
+	log.Printf("%v deleted message %v\n", username, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Periodically hard-delete tombstones older than the retention period, until
+// the server shuts down.
+func (s *Server) purgeTombstones(retention time.Duration) {
+	interval := retention
+	if interval > maxPurgeInterval || interval <= 0 {
+		interval = maxPurgeInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		var purged []string
+		err := s.store.ExecuteAsTransaction(s.ctx, func(ctx context.Context) error {
+			var err error
+			purged, err = s.store.PurgeMessages(ctx, time.Now().Add(-retention))
+			if err != nil || len(purged) == 0 {
+				return err
+			}
+
+			// Drop references to purged messages from users' votes.
+			return s.store.RemoveVotes(ctx, purged)
+		})
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if len(purged) > 0 {
+			log.Printf("Purged %v deleted messages.\n", len(purged))
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Routes for editing messages and viewing their revision history.
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A prior version of a message's content.
+type Revision struct {
+	Content string `bson:"content" json:"content"`
+
+	// Time this version of the content was posted.
+	Created time.Time `bson:"created" json:"created"`
+}
+
+// Body of request to the update message endpoint that edits the message.
+type EditMessageRequestBody struct {
+	Content *string `json:"content"`
+}
+
+// Edit the content of a message. Only the author may edit a message.
+func handleEditMessage(s *Server, w http.ResponseWriter, r *http.Request, id string, content string) {
+	username := r.Header.Get("username")
+	if content == "" {
+		http.Error(w, "content cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	message, err := s.getLiveMessage(id, username)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if message.Author != username {
+		http.Error(w, "Only the author can edit a message.", http.StatusForbidden)
+		return
+	}
+
+	message, err = s.store.EditMessage(s.ctx, id, content, time.Now())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.broadcastEvent(message, eventMessageEdited, message); err != nil {
+		log.Println(err)
+	}
+
+	log.Printf("%v edited message %v\n", username, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Endpoint for getting the prior contents of a message, oldest first.
+func handleGetMessageRevisions(s *Server, w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	message, err := s.getVisibleMessage(id, r.Header.Get("username"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	revisions := message.Revisions
+	if revisions == nil {
+		revisions = []Revision{}
+	}
+	writeJSON(w, http.StatusOK, revisions)
+}
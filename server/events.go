@@ -0,0 +1,227 @@
+// The envelope protocol used for frames sent over the websocket.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Version of the envelope protocol. Frames with a different version are
+// rejected.
+const protocolVersion = 1
+
+// Types of frames sent by the server.
+const (
+	// A new message was posted. The payload is the Message.
+	eventMessageCreated = "message_created"
+
+	// The content of a message was edited. The payload is the updated Message.
+	eventMessageEdited = "message_edited"
+
+	// A message was deleted. The payload is the Message's tombstone.
+	eventMessageDeleted = "message_deleted"
+
+	// A reply was posted to a message. The payload is a ThreadUpdatedPayload.
+	eventThreadUpdated = "thread_updated"
+
+	// The vote count of a message changed. The payload is a VoteUpdatedPayload.
+	eventVoteUpdated = "vote_updated"
+
+	// A user reacted to a message or removed their reaction. The payload is a
+	// ReactionChangedPayload.
+	eventReactionChanged = "reaction_changed"
+
+	// A user read messages up to a message. The payload is a ReadMarker.
+	eventReadReceipt = "read_receipt"
+
+	// The unread counts of the user, sent once the connection is
+	// authenticated. The payload is a list of UnreadCounts.
+	eventUnreadCounts = "unread_counts"
+
+	// A user came online, became idle, or went offline. The payload is a
+	// Presence.
+	eventPresenceChanged = "presence_changed"
+
+	// A user started or stopped typing. The payload is a TypingPayload.
+	eventTyping = "typing"
+
+	// The connection re-authenticated with a new access token. The payload is
+	// an AuthenticatedPayload.
+	eventAuthenticated = "authenticated"
+
+	// Events in a stream the client resumed were missed and cannot be
+	// replayed, so the client should refetch the stream's channel,
+	// conversation, or thread. The payload is a ResyncPayload.
+	eventResync = "resync"
+
+	// Frames for the client were dropped because it did not keep up. The
+	// payload is a GapPayload.
+	eventGap = "gap"
+
+	// An inbound frame could not be handled. The payload is an ErrorPayload.
+	eventError = "error"
+)
+
+// Every frame sent over the websocket in either direction, except for the
+// initial JWT, is an envelope. Type determines the shape of Payload.
+type Envelope struct {
+	// Protocol version.
+	V int `json:"v"`
+
+	Type string `json:"type"`
+
+	// Unique ID of the frame. Chosen by the sender, and echoed back in the
+	// payload of replies.
+	ID string `json:"id,omitempty"`
+
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// Time the frame was sent.
+	TS time.Time `json:"ts"`
+
+	// The stream of a sequenced event sent by the server, and its sequence
+	// number, which increases by one with each event in the stream.
+	Stream string `json:"stream,omitempty"`
+	Seq    int64  `json:"seq,omitempty"`
+}
+
+// Serialize an envelope of the given type around payload.
+func newEnvelope(eventType string, payload interface{}) ([]byte, error) {
+	return newStreamEnvelope(eventType, payload, "", 0)
+}
+
+// Serialize an envelope like newEnvelope, for the event with the given
+// sequence number in a stream.
+func newStreamEnvelope(eventType string, payload interface{}, stream string, seq int64) ([]byte, error) {
+	serializedPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(Envelope{
+		V:       protocolVersion,
+		Type:    eventType,
+		ID:      primitive.NewObjectID().Hex(),
+		Payload: serializedPayload,
+		TS:      time.Now(),
+		Stream:  stream,
+		Seq:     seq,
+	})
+}
+
+// Payload of a vote_updated event.
+type VoteUpdatedPayload struct {
+	// ID of the message.
+	ID string `json:"id"`
+
+	// The new vote total.
+	Votes int `json:"votes"`
+}
+
+// Payload of a thread_updated event.
+type ThreadUpdatedPayload struct {
+	// ID of the parent message.
+	ID string `json:"id"`
+
+	ReplyCount int        `json:"replyCount"`
+	LastReply  *time.Time `json:"lastReply"`
+}
+
+// Payload of an error frame.
+type ErrorPayload struct {
+	// ID of the inbound frame that caused the error, if known.
+	Ref string `json:"ref,omitempty"`
+
+	Message string `json:"message"`
+
+	// Seconds to wait before retrying, if the frame was rate limited.
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+// Where a message or event is sent: a channel, or a direct message
+// conversation.
+type Target struct {
+	Channel string `json:"channel,omitempty"`
+
+	// ID of the conversation. Mutually exclusive with Channel.
+	Conversation string `json:"conversation,omitempty"`
+}
+
+// Return a non-nil error unless the user may post to the target. Defaults the
+// target to the default channel if neither field is set.
+func (s *Server) ensureTargetAccess(username string, target *Target) error {
+	if target.Conversation != "" {
+		if target.Channel != "" {
+			return newAPIError(http.StatusBadRequest, "channel and conversation cannot both be set")
+		}
+		_, err := s.ensureConversationParticipant(target.Conversation, username)
+		return err
+	}
+
+	if target.Channel == "" {
+		target.Channel = defaultChannel
+	}
+	return s.ensureChannelMember(target.Channel, username)
+}
+
+// Return every channel the user has joined, including the default channel, and
+// every conversation they participate in.
+func (s *Server) getUserTargets(username string) ([]Target, error) {
+	targets := []Target{{Channel: defaultChannel}}
+	channels, err := s.store.GetUserChannels(s.ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range channels {
+		if name != defaultChannel {
+			targets = append(targets, Target{Channel: name})
+		}
+	}
+	conversations, err := s.store.GetUserConversations(s.ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	for _, conversation := range conversations {
+		targets = append(targets, Target{Conversation: conversation.ID})
+	}
+
+	return targets, nil
+}
+
+// Broadcast an event about the given message to the clients allowed to see it.
+// Events about replies only go to clients subscribed to the thread.
+func (s *Server) broadcastEvent(message Message, eventType string, payload interface{}) error {
+	if message.ParentID != "" {
+		return s.publishEvent(broadcastMessage{thread: message.ParentID}, threadStream(message.ParentID), eventType, payload)
+	}
+
+	return s.broadcastEventTo(message.target(), eventType, payload)
+}
+
+// Broadcast an event to the members of a channel, or the participants of a
+// conversation, in the stream of the channel or conversation.
+func (s *Server) broadcastEventTo(target Target, eventType string, payload interface{}) error {
+	message, err := s.addressTarget(target)
+	if err != nil {
+		return err
+	}
+
+	return s.publishEvent(message, target.stream(), eventType, payload)
+}
+
+// Address a broadcast to the members of a channel, or the participants of a
+// conversation.
+func (s *Server) addressTarget(target Target) (broadcastMessage, error) {
+	if target.Conversation == "" {
+		return broadcastMessage{channel: target.Channel}, nil
+	}
+
+	conversation, err := s.store.GetConversation(s.ctx, target.Conversation)
+	if err != nil {
+		return broadcastMessage{}, err
+	}
+	return broadcastMessage{recipients: conversation.Participants}, nil
+}
@@ -0,0 +1,277 @@
+// Handlers for frames sent by clients over the websocket.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Handles an inbound frame sent by the given client. Returned apiErrors are
+// reported to the client in an error frame.
+type frameHandler func(s *Server, c *Client, envelope Envelope) error
+
+// Types of frames sent by clients, mapped to their handlers.
+var frameHandlers = map[string]frameHandler{
+	"send_message": handleSendMessageFrame,
+	"typing":       handleTypingFrame,
+	"ack":          handleAckFrame,
+	"subscribe":    handleSubscribeFrame,
+	"unsubscribe":  handleUnsubscribeFrame,
+	"heartbeat":    handleHeartbeatFrame,
+	"authenticate": handleAuthenticateFrame,
+}
+
+// Decode an inbound frame and dispatch it to the handler for its type,
+// replying with an error frame if it cannot be handled.
+func (c *Client) handleFrame(data []byte) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		c.sendError("", "Malformed frame: "+err.Error())
+		return
+	}
+	if envelope.V != protocolVersion {
+		c.sendError(envelope.ID, fmt.Sprintf("Unsupported protocol version: %v.", envelope.V))
+		return
+	}
+	handler, ok := frameHandlers[envelope.Type]
+	if !ok {
+		c.sendError(envelope.ID, "Unknown frame type: "+envelope.Type+".")
+		return
+	}
+
+	err := c.server.takeRateLimit(limitFrames, c.username, c.ip)
+	if err == nil && envelope.Type == "send_message" {
+		err = c.server.takeRateLimit(limitMessages, c.username, c.ip)
+	}
+	if err == nil {
+		err = handler(c.server, c, envelope)
+	}
+	if err != nil {
+		if apiErr, ok := err.(*apiError); ok {
+			c.sendErrorPayload(ErrorPayload{
+				Ref:        envelope.ID,
+				Message:    apiErr.message,
+				RetryAfter: int(math.Ceil(apiErr.retryAfter.Seconds())),
+			})
+			return
+		}
+
+		log.Println(err)
+		c.sendError(envelope.ID, "Internal server error.")
+	}
+}
+
+// Send an error frame to the client in reply to the frame with the given ID.
+func (c *Client) sendError(ref string, message string) {
+	c.sendErrorPayload(ErrorPayload{Ref: ref, Message: message})
+}
+
+// Send an error frame to the client.
+func (c *Client) sendErrorPayload(payload ErrorPayload) {
+	serialized, err := newEnvelope(eventError, payload)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	c.hub.send(broadcastMessage{client: c, data: serialized})
+}
+
+// Decode the payload of an envelope into v.
+func decodePayload(envelope Envelope, v interface{}) error {
+	if err := json.Unmarshal(envelope.Payload, v); err != nil {
+		return newAPIError(http.StatusBadRequest, "Malformed payload: "+err.Error())
+	}
+	return nil
+}
+
+// Post a message. The payload has the same format as the body of the create
+// message endpoint.
+func handleSendMessageFrame(s *Server, c *Client, envelope Envelope) error {
+	var payload CreateMessageRequestBody
+	if err := decodePayload(envelope, &payload); err != nil {
+		return err
+	}
+
+	_, err := s.createMessage(c.username, payload)
+	return err
+}
+
+// Payload of a typing frame sent by a client.
+type TypingFramePayload struct {
+	Target
+
+	// Either "start", the default, or "stop".
+	State string `json:"state"`
+}
+
+// Payload of a typing event sent by the server.
+type TypingPayload struct {
+	Username string `json:"username"`
+	Target
+
+	// Whether the user started or stopped typing.
+	Typing bool `json:"typing"`
+}
+
+// Tell the other users in a channel or conversation that the client's user
+// started or stopped typing. Clients should repeat start frames while the user
+// keeps typing, as the typing state expires after typing-timeout.
+func handleTypingFrame(s *Server, c *Client, envelope Envelope) error {
+	var payload TypingFramePayload
+	if err := decodePayload(envelope, &payload); err != nil {
+		return err
+	}
+	if err := s.ensureTargetAccess(c.username, &payload.Target); err != nil {
+		return err
+	}
+
+	switch payload.State {
+	case "", "start":
+		s.typing.start(c.username, payload.Target)
+	case "stop":
+		s.typing.stop(c.username, payload.Target)
+	default:
+		return newAPIError(http.StatusBadRequest, "state must be start or stop")
+	}
+	return nil
+}
+
+// Payload of an ack frame. At least one field must be set.
+type AckFramePayload struct {
+	// ID of the frame being acknowledged.
+	ID string `json:"id"`
+
+	// ID of the latest message the user has read.
+	Message string `json:"message"`
+}
+
+// Acknowledge receipt of a frame sent by the server, or that the user has read
+// messages up to and including a message.
+func handleAckFrame(s *Server, c *Client, envelope Envelope) error {
+	var payload AckFramePayload
+	if err := decodePayload(envelope, &payload); err != nil {
+		return err
+	}
+	if payload.ID == "" && payload.Message == "" {
+		return newAPIError(http.StatusBadRequest, "Missing ID of acknowledged frame or message.")
+	}
+
+	if payload.ID != "" {
+		log.Printf("%v acknowledged frame %v\n", c.username, payload.ID)
+	}
+	if payload.Message != "" {
+		return s.markRead(c.username, payload.Message)
+	}
+	return nil
+}
+
+// Payload of subscribe and unsubscribe frames. Exactly one field must be set.
+type SubscribeFramePayload struct {
+	Channel string `json:"channel"`
+
+	// ID of the parent message of a thread.
+	Thread string `json:"thread"`
+}
+
+// Decode a subscribe or unsubscribe frame into a change to the client's
+// subscriptions.
+func decodeSubscription(c *Client, envelope Envelope, subscribed bool) (membershipChange, error) {
+	var payload SubscribeFramePayload
+	if err := decodePayload(envelope, &payload); err != nil {
+		return membershipChange{}, err
+	}
+	if (payload.Channel == "") == (payload.Thread == "") {
+		return membershipChange{}, newAPIError(http.StatusBadRequest, "Exactly one of channel and thread must be set.")
+	}
+
+	return membershipChange{client: c, channel: payload.Channel, thread: payload.Thread, joined: subscribed}, nil
+}
+
+// Start streaming a joined channel's messages, or a thread's replies, to this
+// connection.
+func handleSubscribeFrame(s *Server, c *Client, envelope Envelope) error {
+	change, err := decodeSubscription(c, envelope, true)
+	if err != nil {
+		return err
+	}
+	if change.thread != "" {
+		if _, err := s.getVisibleMessage(change.thread, c.username); err != nil {
+			return err
+		}
+	} else if err := s.ensureChannelMember(change.channel, c.username); err != nil {
+		return err
+	}
+
+	s.hub.changeMembership(change)
+	return nil
+}
+
+// Stop streaming a channel's messages, or a thread's replies, to this
+// connection. Presence is streamed on the default channel, so connections
+// cannot unsubscribe from it.
+func handleUnsubscribeFrame(s *Server, c *Client, envelope Envelope) error {
+	change, err := decodeSubscription(c, envelope, false)
+	if err != nil {
+		return err
+	}
+	if change.thread == "" && change.channel == defaultChannel {
+		return newAPIError(http.StatusBadRequest, "Cannot unsubscribe from the default channel.")
+	}
+
+	s.hub.changeMembership(change)
+	return nil
+}
+
+// Keep the client's user from becoming idle. Every inbound frame counts as
+// activity, so there is nothing more to do.
+func handleHeartbeatFrame(s *Server, c *Client, envelope Envelope) error {
+	return nil
+}
+
+// Payload of an authenticate frame.
+type AuthenticateFramePayload struct {
+	// A new access token for the same user.
+	Token string `json:"token"`
+}
+
+// Payload of an authenticated event.
+type AuthenticatedPayload struct {
+	// When the new access token expires.
+	Expires time.Time `json:"expires"`
+}
+
+// Extend the connection with a new access token for the same user, so that it
+// is not closed when its current token expires.
+func handleAuthenticateFrame(s *Server, c *Client, envelope Envelope) error {
+	var payload AuthenticateFramePayload
+	if err := decodePayload(envelope, &payload); err != nil {
+		return err
+	}
+	claims, err := s.verifyAccessToken(payload.Token)
+	if err != nil {
+		return newAPIError(http.StatusUnauthorized, "Error verifying JWT: "+err.Error())
+	}
+	if claims.Username != c.username {
+		return newAPIError(http.StatusForbidden, "Token was issued to a different user.")
+	}
+	c.setToken(claims)
+
+	// Replace any expiry the write goroutine has not picked up yet.
+	select {
+	case <-c.reauthenticated:
+	default:
+	}
+	c.reauthenticated <- claims.Expires
+
+	serialized, err := newEnvelope(eventAuthenticated, AuthenticatedPayload{Expires: claims.Expires})
+	if err != nil {
+		return err
+	}
+	s.hub.send(broadcastMessage{client: c, data: serialized})
+
+	return nil
+}
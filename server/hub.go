@@ -1,51 +1,482 @@
 package main
 
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
 // Hub maintains the set of active websocket connections.
 type Hub struct {
 	// Registered clients.
 	clients map[*Client]bool
 
 	// Inbound messages from clients.
-	broadcast chan []byte
+	broadcast chan broadcastMessage
 
 	// Register requests from clients.
-	register chan *Client
+	register chan registration
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Channel joins and leaves to apply to registered clients.
+	membership chan membershipChange
+
+	// Clients that the user has interacted with.
+	activity chan *Client
+
+	// Fans events out to the hubs of every replica.
+	broker Broker
+
+	// Events waiting to be published through the broker, so that publishers
+	// never wait for the broker.
+	outbox chan BrokerEvent
+
+	// Events published through the broker by any replica.
+	events <-chan BrokerEvent
+
+	// Sizes of the queues and what to do when a client's queue is full.
+	config fanoutConfig
+
+	// Time without activity on any connection before a user is idle.
+	idleTimeout time.Duration
+
+	// Delivery order of each stream with recent events, keyed by stream.
+	streams map[string]*streamOrder
+
+	// Requests to close every connection because the server is shutting down.
+	closeRequests chan struct{}
+
+	// Whether the server is shutting down, so that clients registering are
+	// refused.
+	closing bool
+
+	// Counts the read and write goroutines of connections. Only the hub
+	// goroutine adds to it, when it registers a client, so that nothing is
+	// added once closeConnections has started waiting.
+	connections sync.WaitGroup
+
+	// Closed to stop the hub once queued events are published.
+	quit chan struct{}
+
+	// Closed once queued events are published after quit is closed.
+	forwarded chan struct{}
+
+	// Closed once the hub has stopped.
+	stopped chan struct{}
+
+	// Requests for the presence of every known user.
+	presenceRequests chan chan []Presence
+
+	// ID of this replica in the presence it publishes.
+	replica string
+
+	// Presence of each user on this replica as last published, keyed by
+	// username.
+	published map[string]ReplicaPresence
+
+	// Presence published by each replica, including this one, keyed by
+	// replica ID.
+	replicas map[string]*replicaPresences
+
+	// Last presence state broadcast for each user, keyed by username.
+	states map[string]string
+
+	// When each user that went offline was last active on this replica, keyed
+	// by username.
+	lastSeen map[string]time.Time
+}
+
+// A serialized message to deliver to every client subscribed to a channel, or,
+// if recipients is set, to every client authenticated as one of the recipients,
+// or, if thread is set, to every client subscribed to the thread, or, if client
+// is set, to that client alone. Clients authenticated as except are skipped.
+// Sequenced events also carry their stream and sequence number.
+type broadcastMessage struct {
+	channel    string
+	recipients []string
+	thread     string
+	client     *Client
+	except     string
+	stream     string
+	seq        int64
+	data       []byte
+}
+
+// A serialized frame queued for a client, with the stream and sequence number
+// of sequenced events.
+type outboundFrame struct {
+	stream string
+	seq    int64
+	data   []byte
+}
+
+// Return whether the client should receive the message.
+func (m broadcastMessage) isFor(client *Client) bool {
+	if m.client != nil {
+		return m.client == client
+	}
+	if m.except != "" && m.except == client.username {
+		return false
+	}
+	if m.thread != "" {
+		return client.threads[m.thread]
+	}
+	if m.recipients == nil {
+		return client.channels[m.channel]
+	}
+	for _, recipient := range m.recipients {
+		if recipient == client.username {
+			return true
+		}
+	}
+	return false
+}
+
+// A user joining or leaving a channel, or, if thread is set, subscribing to or
+// unsubscribing from a thread. Applies to every client of the user, or, if
+// client is set, to that client alone.
+type membershipChange struct {
+	username string
+	client   *Client
+	channel  string
+	thread   string
+	joined   bool
+}
+
+// Return whether the change applies to the client.
+func (c membershipChange) isFor(client *Client) bool {
+	if c.client != nil {
+		return c.client == client
+	}
+	return c.username == client.username
 }
 
 // Create a new hub.
-func newHub() *Hub {
+func newHub(ctx context.Context, broker Broker, config fanoutConfig, idleTimeout time.Duration) *Hub {
+	events, err := broker.Subscribe(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	return &Hub{
 		clients:    make(map[*Client]bool),
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
+		broadcast:  make(chan broadcastMessage),
+		register:   make(chan registration),
 		unregister: make(chan *Client),
+		membership: make(chan membershipChange),
+
+		activity:         make(chan *Client),
+		presenceRequests: make(chan chan []Presence),
+		replica:          primitive.NewObjectID().Hex(),
+		published:        make(map[string]ReplicaPresence),
+		replicas:         make(map[string]*replicaPresences),
+		states:           make(map[string]string),
+		lastSeen:         make(map[string]time.Time),
+
+		broker:  broker,
+		outbox:  make(chan BrokerEvent, config.PublishQueueSize),
+		events:  events,
+		config:  config,
+		streams: make(map[string]*streamOrder),
+
+		idleTimeout: idleTimeout,
+
+		closeRequests: make(chan struct{}),
+		quit:          make(chan struct{}),
+		forwarded:     make(chan struct{}),
+		stopped:       make(chan struct{}),
 	}
 }
 
-// Start broadcasting messages.
+// Start broadcasting messages, until stopped.
 func (h *Hub) run() {
+	defer close(h.stopped)
+	go h.forward()
+
+	idleTicker := time.NewTicker(idleCheckInterval)
+	defer idleTicker.Stop()
+	reorderTicker := time.NewTicker(reorderCheckInterval)
+	defer reorderTicker.Stop()
+
 	for {
 		select {
-		case client := <-h.register:
+		case r := <-h.register:
+			if h.closing {
+				r.accepted <- false
+				continue
+			}
+			h.connections.Add(2)
+			r.accepted <- true
+			client := r.client
+			client.lastActive = time.Now()
 			h.clients[client] = true
+			h.updatePresence(client.username)
 		case client := <-h.unregister:
+			h.removeClient(client, websocket.CloseNormalClosure, "")
+		case client := <-h.activity:
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+				client.lastActive = time.Now()
+				h.updatePresence(client.username)
 			}
+		case event := <-h.events:
+			h.handleEvent(event)
+		case <-idleTicker.C:
+			h.publishAllPresence()
+			h.expirePresence()
+		case now := <-reorderTicker.C:
+			h.expireStreamOrders(now)
+		case request := <-h.presenceRequests:
+			request <- h.allPresence()
+		case change := <-h.membership:
+			h.applyMembership(change)
 		case message := <-h.broadcast:
+			h.deliver(message)
+		case <-h.closeRequests:
+			h.closing = true
 			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					// If client send channel is full, unregister the client.
-					delete(h.clients, client)
-					close(client.send)
-				}
+				h.removeClient(client, websocket.CloseGoingAway, reconnectReason)
+			}
+		case <-h.forwarded:
+			return
+		}
+	}
+}
+
+// Close every connection with a close frame telling the client to reconnect,
+// refuse later registrations, and wait until the goroutines of the
+// connections exit or ctx is done.
+func (h *Hub) closeConnections(ctx context.Context) error {
+	h.closeRequests <- struct{}{}
+
+	closed := make(chan struct{})
+	go func() {
+		h.connections.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Publish the queued events and stop the hub, or give up when ctx is done.
+func (h *Hub) stop(ctx context.Context) error {
+	close(h.quit)
+	select {
+	case <-h.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// A request to register a client, answered with whether it was accepted.
+type registration struct {
+	client   *Client
+	accepted chan bool
+}
+
+// Register a client, counting its read and write goroutines, which the caller
+// must then start. Returns false if the hub is closing connections or has
+// stopped.
+func (h *Hub) registerClient(client *Client) bool {
+	r := registration{client: client, accepted: make(chan bool, 1)}
+	select {
+	case h.register <- r:
+		return <-r.accepted
+	case <-h.stopped:
+		return false
+	}
+}
+
+// Unregister a client, unless the hub has stopped.
+func (h *Hub) unregisterClient(client *Client) {
+	select {
+	case h.unregister <- client:
+	case <-h.stopped:
+	}
+}
+
+// Record that the user interacted with a client, unless the hub has stopped.
+func (h *Hub) touch(client *Client) {
+	select {
+	case h.activity <- client:
+	case <-h.stopped:
+	}
+}
+
+// Queue a message for the local clients it is for, unless the hub has
+// stopped.
+func (h *Hub) send(message broadcastMessage) {
+	select {
+	case h.broadcast <- message:
+	case <-h.stopped:
+	}
+}
+
+// Apply a membership change to the local clients, unless the hub has
+// stopped.
+func (h *Hub) changeMembership(change membershipChange) {
+	select {
+	case h.membership <- change:
+	case <-h.stopped:
+	}
+}
+
+// Apply an event published through the broker to the local clients.
+func (h *Hub) handleEvent(event BrokerEvent) {
+	switch {
+	case event.Message != nil:
+		message := event.Message.broadcast()
+		if message.seq != 0 {
+			h.deliverInOrder(message)
+		} else {
+			h.deliver(message)
+		}
+	case event.Membership != nil:
+		h.applyMembership(membershipChange{
+			username: event.Membership.Username,
+			channel:  event.Membership.Channel,
+			joined:   event.Membership.Joined,
+		})
+	case event.Revoked != nil:
+		ids := map[string]bool{}
+		for _, id := range event.Revoked {
+			ids[id] = true
+		}
+		for client := range h.clients {
+			if client.hasToken(ids) {
+				h.removeClient(client, websocket.ClosePolicyViolation, "session revoked")
+			}
+		}
+	case event.Presence != nil:
+		h.applyPresence(*event.Presence)
+	case event.Disconnect != "":
+		for client := range h.clients {
+			if client.username == event.Disconnect {
+				h.removeClient(client, websocket.ClosePolicyViolation, "banned")
+			}
+		}
+	}
+}
+
+// Subscribe or unsubscribe the clients a membership change applies to.
+func (h *Hub) applyMembership(change membershipChange) {
+	for client := range h.clients {
+		if !change.isFor(client) {
+			continue
+		}
+		subscriptions, key := client.channels, change.channel
+		if change.thread != "" {
+			subscriptions, key = client.threads, change.thread
+		}
+		if change.joined {
+			subscriptions[key] = true
+		} else {
+			delete(subscriptions, key)
+		}
+	}
+}
+
+// Queue an event to be published to the hubs of every replica, including this
+// one, in the order events are queued. Returns errPublishQueueFull instead of
+// waiting if too many events are queued.
+func (h *Hub) publish(event BrokerEvent) error {
+	select {
+	case h.outbox <- event:
+		return nil
+	default:
+		publishesDropped.Add(1)
+		return errPublishQueueFull
+	}
+}
+
+// Publish queued events through the broker, until the hub is stopped.
+func (h *Hub) forward() {
+	defer close(h.forwarded)
+
+	for {
+		select {
+		case event := <-h.outbox:
+			h.forwardEvent(event)
+		case <-h.quit:
+			for len(h.outbox) > 0 {
+				h.forwardEvent(<-h.outbox)
 			}
+			return
 		}
 	}
 }
+
+// Publish an event through the broker.
+func (h *Hub) forwardEvent(event BrokerEvent) {
+	if err := h.broker.Publish(context.TODO(), event); err != nil {
+		log.Println(err)
+	}
+}
+
+// Publish a message to the clients it is for on every replica. The message
+// must not target a single client.
+func (h *Hub) publishMessage(message broadcastMessage) error {
+	return h.publish(BrokerEvent{Message: &BrokerMessage{
+		Channel:    message.channel,
+		Recipients: message.recipients,
+		Thread:     message.thread,
+		Except:     message.except,
+		Stream:     message.stream,
+		Seq:        message.seq,
+		Data:       message.data,
+	}})
+}
+
+// Publish a user joining or leaving a channel to every replica.
+func (h *Hub) publishMembership(username string, channel string, joined bool) error {
+	return h.publish(BrokerEvent{Membership: &BrokerMembership{Username: username, Channel: channel, Joined: joined}})
+}
+
+// Queue a message for every registered client it is for, applying the
+// overflow policy to clients whose queues are full.
+func (h *Hub) deliver(message broadcastMessage) {
+	frame := outboundFrame{stream: message.stream, seq: message.seq, data: message.data}
+	for client := range h.clients {
+		if !message.isFor(client) || client.send.push(frame) {
+			continue
+		}
+
+		switch h.config.Overflow {
+		case overflowDropOldest:
+			client.send.dropOldest()
+			client.send.push(frame)
+			framesDropped.Add(1)
+		case overflowDisconnect:
+			log.Printf("Send queue of %v is full, closing connection.\n", client.username)
+			h.removeClient(client, closeSlowConsumer, "slow consumer")
+			slowConsumerDisconnects.Add(1)
+		}
+	}
+}
+
+// Unregister a client and close its send queue with the given close code and
+// reason, if it is registered.
+func (h *Hub) removeClient(client *Client, code int, reason string) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	delete(h.clients, client)
+	client.send.close(code, reason)
+
+	// The user was last seen when the connection was last active, not when it
+	// closed.
+	if seen, ok := h.lastSeen[client.username]; !ok || client.lastActive.After(seen) {
+		h.lastSeen[client.username] = client.lastActive
+	}
+	h.updatePresence(client.username)
+}
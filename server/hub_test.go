@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Create a hub on the memory broker, running until the test ends.
+func newTestHub(t *testing.T, config fanoutConfig) *Hub {
+	t.Helper()
+
+	h := newHub(context.Background(), newMemoryBroker(), config, time.Minute)
+	go h.run()
+	t.Cleanup(func() {
+		h.stop(context.Background())
+	})
+
+	return h
+}
+
+// Create a client of the hub that is not connected to a websocket.
+func newTestClient(h *Hub, username string) *Client {
+	return &Client{
+		hub:      h,
+		username: username,
+		channels: map[string]bool{defaultChannel: true},
+		threads:  map[string]bool{},
+		send:     newSendQueue(h.config.QueueSize),
+	}
+}
+
+// Closing connections must wait for the goroutines of every registered
+// client, and refuse clients registering afterwards.
+func TestCloseConnections(t *testing.T) {
+	h := newTestHub(t, defaultFanoutConfig)
+	if !h.registerClient(newTestClient(h, "alice")) {
+		t.Fatal("registration refused before closing connections")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	closed := make(chan error, 1)
+	go func() {
+		closed <- h.closeConnections(ctx)
+	}()
+
+	// Stand in for the read and write goroutines of the client exiting.
+	select {
+	case err := <-closed:
+		t.Fatalf("closeConnections returned %v before the client's goroutines exited", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	h.connections.Done()
+	h.connections.Done()
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+
+	if h.registerClient(newTestClient(h, "bob")) {
+		t.Error("registration accepted after closing connections")
+	}
+}
+
+// A full queue drops its oldest frames, and the write goroutine tells the
+// client what it missed before sending the frames still queued.
+func TestOverflowDropOldest(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.Fanout.QueueSize = 2
+	})
+	stream := Target{Channel: defaultChannel}.stream()
+	client := newTestClient(s.hub, "alice")
+
+	// The hub is not running, so the test owns its state.
+	h := newHub(context.Background(), newMemoryBroker(), s.hub.config, time.Minute)
+	peer := startTestWriter(t, s, client, func() {
+		h.clients[client] = true
+		for seq := int64(1); seq <= 3; seq++ {
+			data, err := newStreamEnvelope(eventResync, ResyncPayload{}, stream, seq)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.deliver(broadcastMessage{channel: defaultChannel, stream: stream, seq: seq, data: data})
+		}
+		h.removeClient(client, websocket.CloseNormalClosure, "")
+	})
+
+	envelopes, _ := readUntilClosed(t, peer)
+	if len(envelopes) != 3 || envelopes[0].Type != eventGap || envelopes[1].Seq != 2 || envelopes[2].Seq != 3 {
+		t.Fatalf("got %+v, want a gap and events 2 and 3", envelopes)
+	}
+	var gap GapPayload
+	if err := json.Unmarshal(envelopes[0].Payload, &gap); err != nil {
+		t.Fatal(err)
+	}
+	if gap.Dropped != 1 || len(gap.Streams) != 1 || gap.Streams[stream] != 1 {
+		t.Errorf("got gap %+v, want event 1 dropped", gap)
+	}
+}
+
+// A full queue disconnects the client with closeSlowConsumer, after the
+// frames already queued.
+func TestOverflowDisconnect(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.Fanout.QueueSize = 2
+		config.Fanout.Overflow = overflowDisconnect
+	})
+	client := newTestClient(s.hub, "alice")
+
+	// The hub is not running, so the test owns its state.
+	h := newHub(context.Background(), newMemoryBroker(), s.hub.config, time.Minute)
+	peer := startTestWriter(t, s, client, func() {
+		h.clients[client] = true
+		for i := 0; i < 3; i++ {
+			data, err := newEnvelope(eventResync, ResyncPayload{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.deliver(broadcastMessage{channel: defaultChannel, data: data})
+		}
+	})
+
+	if h.clients[client] {
+		t.Error("slow client is still registered")
+	}
+	envelopes, code := readUntilClosed(t, peer)
+	if len(envelopes) != 2 || code != closeSlowConsumer {
+		t.Errorf("got %v frames and close code %v, want 2 and %v", len(envelopes), code, closeSlowConsumer)
+	}
+}
+
+// Publishing never waits for the broker, failing once the outbox is full.
+func TestPublishQueueFull(t *testing.T) {
+	config := defaultFanoutConfig
+	config.PublishQueueSize = 1
+	h := newHub(context.Background(), newMemoryBroker(), config, time.Minute)
+
+	if err := h.publishMessage(broadcastMessage{channel: defaultChannel}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.publishMessage(broadcastMessage{channel: defaultChannel}); err != errPublishQueueFull {
+		t.Errorf("got %v, want %v", err, errPublishQueueFull)
+	}
+}
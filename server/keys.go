@@ -0,0 +1,236 @@
+// Keys for signing and verifying access tokens, and the JWKS endpoint
+// publishing the public ones.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Minimum length of an HMAC secret in bytes.
+const minSecretLength = 32
+
+// A key identified by the kid header of the tokens it signs.
+type signingKey struct {
+	id     string
+	method jwt.SigningMethod
+
+	// Nil for keys that are only used to verify tokens signed before a
+	// rotation.
+	private interface{}
+
+	public interface{}
+}
+
+// The keys trusted to verify access tokens, and the one new tokens are signed
+// with.
+type keyring struct {
+	keys    map[string]*signingKey
+	signing *signingKey
+}
+
+// Parse a PEM-encoded RSA or Ed25519 key. Private keys can sign tokens, and
+// public keys can only verify them.
+func parsePEMKey(id string, data []byte) (*signingKey, error) {
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		return &signingKey{id: id, method: jwt.SigningMethodRS256, private: key, public: &key.PublicKey}, nil
+	}
+	if key, err := jwt.ParseEdPrivateKeyFromPEM(data); err == nil {
+		private := key.(ed25519.PrivateKey)
+		return &signingKey{id: id, method: jwt.SigningMethodEdDSA, private: private, public: private.Public()}, nil
+	}
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return &signingKey{id: id, method: jwt.SigningMethodRS256, public: key}, nil
+	}
+	if key, err := jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+		return &signingKey{id: id, method: jwt.SigningMethodEdDSA, public: key}, nil
+	}
+
+	return nil, fmt.Errorf("not an RSA or Ed25519 key")
+}
+
+// Create an HS256 key from a shared secret.
+func newSecretKey(id string, secret []byte) (*signingKey, error) {
+	if len(secret) < minSecretLength {
+		return nil, fmt.Errorf("secret must be at least %v bytes", minSecretLength)
+	}
+
+	return &signingKey{id: id, method: jwt.SigningMethodHS256, private: secret, public: secret}, nil
+}
+
+// Load every key in dir. Each key's ID is its file name without the
+// extension: .pem files hold RSA or Ed25519 keys, and .secret files hold HMAC
+// secrets.
+func loadKeyDir(dir string) (map[string]*signingKey, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*signingKey{}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".pem" && ext != ".secret") {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ext)
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var key *signingKey
+		if ext == ".pem" {
+			key, err = parsePEMKey(id, data)
+		} else {
+			key, err = newSecretKey(id, []byte(strings.TrimSpace(string(data))))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", entry.Name(), err)
+		}
+		keys[id] = key
+	}
+
+	return keys, nil
+}
+
+// Load the keys in the configured directory, and choose the one with the
+// configured ID to sign tokens, or use the configured secret if there is no
+// directory.
+func newKeyring(config *Config) *keyring {
+	var keys map[string]*signingKey
+	if dir := config.JWTKeysDir; dir != "" {
+		var err error
+		if keys, err = loadKeyDir(dir); err != nil {
+			log.Fatalf("invalid jwt-keys-dir: %v", err)
+		}
+	} else if secret := config.JWTSigningKey; secret != "" {
+		key, err := newSecretKey("default", []byte(secret))
+		if err != nil {
+			log.Fatalf("invalid jwt-signing-key: %v", err)
+		}
+		keys = map[string]*signingKey{key.id: key}
+	} else {
+		// Config.validate only allows this with the memory backends.
+		log.Println("No JWT signing key configured, using a random key. Tokens will not survive a restart.")
+		secret := make([]byte, minSecretLength)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatal(err)
+		}
+		key, _ := newSecretKey("ephemeral", secret)
+		keys = map[string]*signingKey{key.id: key}
+	}
+
+	ring := &keyring{keys: keys}
+	if id := config.JWTSigningKeyID; id != "" {
+		ring.signing = keys[id]
+		if ring.signing == nil || ring.signing.private == nil {
+			log.Fatalf("invalid jwt-signing-key-id: no private key %v", id)
+		}
+	} else {
+		for _, key := range keys {
+			if key.private == nil {
+				continue
+			}
+			if ring.signing != nil {
+				log.Fatal("jwt-signing-key-id is required when there is more than one private key")
+			}
+			ring.signing = key
+		}
+		if ring.signing == nil {
+			log.Fatal("no private JWT signing key configured")
+		}
+	}
+
+	log.Printf("Signing tokens with %v key %v, trusting %v keys.\n", ring.signing.method.Alg(), ring.signing.id, len(keys))
+	return ring
+}
+
+// Sign a token with the signing key, identifying it in the kid header.
+func (k *keyring) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.signing.method, claims)
+	token.Header["kid"] = k.signing.id
+
+	return token.SignedString(k.signing.private)
+}
+
+// Return the key that signed a token, as named by its kid header, making sure
+// the token uses the key's algorithm.
+func (k *keyring) verificationKey(token *jwt.Token) (interface{}, error) {
+	id, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, fmt.Errorf("token has no key ID")
+	}
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID: %v", id)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	return key.public, nil
+}
+
+// A public key in JSON Web Key format.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	ID        string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+
+	// RSA modulus and exponent.
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// Ed25519 curve and public key.
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// Response of the JWKS endpoint.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Return the public keys in JSON Web Key format, sorted by ID. HMAC secrets
+// are never published.
+func (k *keyring) jwks() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range k.keys {
+		jwk := JWK{ID: key.id, Algorithm: key.method.Alg(), Use: "sig"}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].ID < set.Keys[j].ID })
+
+	return set
+}
+
+// Endpoint for getting the public keys access tokens can be verified with.
+func handleGetJWKS(s *Server, w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.keys.jwks())
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Create a keyring that signs tokens with a single key.
+func newTestKeyring(key *signingKey) *keyring {
+	return &keyring{keys: map[string]*signingKey{key.id: key}, signing: key}
+}
+
+// An authenticate frame carrying an access token signed with any supported
+// algorithm must fit in the default max-message-size, or re-authenticating
+// closes the connection.
+func TestAuthenticateFrameFitsMaxMessageSize(t *testing.T) {
+	secret, err := newSecretKey("hs256", []byte(strings.Repeat("s", minSecretLength)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []*signingKey{
+		secret,
+		{id: "eddsa", method: jwt.SigningMethodEdDSA, private: edPrivate, public: edPrivate.Public()},
+	}
+	for _, bits := range []int{2048, 4096} {
+		rsaPrivate, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, &signingKey{id: "rs256", method: jwt.SigningMethodRS256, private: rsaPrivate, public: &rsaPrivate.PublicKey})
+	}
+
+	limit := defaultConfig().MaxMessageSize
+	for _, key := range keys {
+		s := &Server{config: defaultConfig(), keys: newTestKeyring(key)}
+		token, err := s.generateJWT(strings.Repeat("u", 32), strings.Repeat("f", 24), []Role{roleUser, roleModerator, roleAdmin})
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := json.Marshal(AuthenticateFramePayload{Token: token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame, err := json.Marshal(Envelope{V: protocolVersion, Type: "authenticate", ID: strings.Repeat("i", 36), Payload: payload, TS: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if int64(len(frame)) > limit {
+			t.Errorf("%v: authenticate frame is %v bytes, more than the default max-message-size of %v", key.method.Alg(), len(frame), limit)
+		}
+	}
+}
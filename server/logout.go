@@ -0,0 +1,75 @@
+// Routes for logging out, and revocation of access tokens.
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// Revoke the access tokens with the given IDs, or issued in the sessions with
+// the given IDs, delete the sessions' refresh tokens, and disconnect any
+// websocket authenticated with a revoked token.
+func (s *Server) revokeTokens(ids []string, sessions []string) error {
+	// Every access token still valid was issued less than
+	// access-token-lifetime ago, so nothing needs to be remembered for longer
+	// than that.
+	expires := time.Now().Add(s.config.AccessTokenLifetime)
+	if err := s.store.RevokeTokens(s.ctx, append(append([]string{}, ids...), sessions...), expires); err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if err := s.store.RevokeRefreshTokenFamily(s.ctx, session); err != nil {
+			return err
+		}
+	}
+
+	// The tokens are revoked whether or not their connections are closed now,
+	// since every request checks for revocation.
+	if err := s.hub.publish(BrokerEvent{Revoked: append(append([]string{}, ids...), sessions...)}); err != nil {
+		log.Println(err)
+	}
+
+	return nil
+}
+
+// Revoke every token issued in the given sessions.
+func (s *Server) revokeSessions(sessions []string) error {
+	return s.revokeTokens(nil, sessions)
+}
+
+// Endpoint for logging out of the session the request's access token was
+// issued in.
+func handleLogout(s *Server, w http.ResponseWriter, r *http.Request) {
+	username := r.Header.Get("username")
+
+	if err := s.revokeTokens([]string{r.Header.Get("jti")}, []string{r.Header.Get("session")}); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	log.Printf("%v logged out\n", username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Endpoint for logging out of every session of the user.
+func handleLogoutAll(s *Server, w http.ResponseWriter, r *http.Request) {
+	username := r.Header.Get("username")
+
+	sessions, err := s.store.GetUserSessions(s.ctx, username)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// The current session may have no refresh tokens left if its login
+	// expired, but its access token is still valid.
+	sessions = append(sessions, r.Header.Get("session"))
+	if err := s.revokeTokens([]string{r.Header.Get("jti")}, sessions); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	log.Printf("%v logged out of %v sessions\n", username, len(sessions))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,11 +1,33 @@
 // A minimal echo server.
 package main
 
-import "log"
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+)
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	s := newServer()
+	config, printConfig, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	// Print the configuration even if it is invalid, to help fix it.
+	if printConfig && config != nil {
+		if err := config.print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if printConfig {
+		return
+	}
+
+	s := newServer(config)
 	s.setUpRoutes()
 	s.start()
 }
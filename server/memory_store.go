@@ -0,0 +1,1093 @@
+// A Store that keeps all state in process memory.
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Transactions of the memory store are atomic with respect to each other, but
+// not isolated: calls made outside a transaction see its writes before it
+// commits, and keep them if they overwrote them before it rolled back.
+type memoryStore struct {
+	// Guards the collections below.
+	mu sync.Mutex
+
+	// Serializes transactions so they cannot interleave.
+	txMu sync.Mutex
+
+	// Users keyed by username.
+	users map[string]User
+
+	// Messages keyed by ID.
+	messages map[string]Message
+
+	// Channels keyed by name.
+	channels map[string]Channel
+
+	// Conversations keyed by ID.
+	conversations map[string]Conversation
+
+	// Read markers keyed by user and channel or conversation.
+	readMarkers map[readMarkerKey]ReadMarker
+
+	// Refresh tokens keyed by ID.
+	refreshTokens map[string]RefreshToken
+
+	// Expiry times of revocations, keyed by the revoked token or session ID.
+	revokedTokens map[string]time.Time
+
+	// Moderation actions, oldest first.
+	moderationActions []ModerationAction
+
+	// Latest sequence numbers keyed by stream.
+	sequences map[string]int64
+
+	// Events keyed by stream, in order.
+	streamEvents map[string][]StreamEvent
+
+	// How long events are kept for replay.
+	replayRetention time.Duration
+
+	// Inverted index from each token of message content to the IDs of the
+	// messages containing it.
+	index map[string]map[string]struct{}
+}
+
+// Identifies a user's read marker in a channel or conversation.
+type readMarkerKey struct {
+	username string
+	target   Target
+}
+
+// Key under which the active transaction is stored in a context.
+type memoryTxKey struct{}
+
+// An in-progress transaction, recording how to undo each write made so far.
+type memoryTx struct {
+	undo []func()
+}
+
+// Create a new empty store, which keeps sequenced events for replayRetention.
+func newMemoryStore(replayRetention time.Duration) *memoryStore {
+	return &memoryStore{
+		replayRetention: replayRetention,
+
+		users:         make(map[string]User),
+		messages:      make(map[string]Message),
+		channels:      make(map[string]Channel),
+		conversations: make(map[string]Conversation),
+		readMarkers:   make(map[readMarkerKey]ReadMarker),
+		refreshTokens: make(map[string]RefreshToken),
+		revokedTokens: make(map[string]time.Time),
+		sequences:     make(map[string]int64),
+		streamEvents:  make(map[string][]StreamEvent),
+		index:         make(map[string]map[string]struct{}),
+	}
+}
+
+// Record how to revert a write if it was made inside a transaction. Must be
+// called with m.mu held.
+func (m *memoryStore) recordUndo(ctx context.Context, undo func()) {
+	if tx, ok := ctx.Value(memoryTxKey{}).(*memoryTx); ok {
+		tx.undo = append(tx.undo, undo)
+	}
+}
+
+// Record how to revert a write to some fields of a user. undo is applied to a
+// copy of the user as it is when the transaction rolls back, so that fields
+// written outside the transaction in the meantime are kept. Must be called
+// with m.mu held.
+func (m *memoryStore) recordUserUndo(ctx context.Context, username string, undo func(user *User)) {
+	m.recordUndo(ctx, func() {
+		if user, ok := m.users[username]; ok {
+			user = cloneUser(user)
+			undo(&user)
+			m.users[username] = user
+		}
+	})
+}
+
+// Record how to revert a write to some fields of a message, like
+// recordUserUndo. Must be called with m.mu held.
+func (m *memoryStore) recordMessageUndo(ctx context.Context, id string, undo func(message *Message)) {
+	m.recordUndo(ctx, func() {
+		if message, ok := m.messages[id]; ok {
+			message.Reactions = cloneReactions(message.Reactions)
+			undo(&message)
+			m.messages[id] = message
+		}
+	})
+}
+
+// Record how to revert a write to the members of a channel, like
+// recordUserUndo. Must be called with m.mu held.
+func (m *memoryStore) recordChannelUndo(ctx context.Context, name string, undo func(channel *Channel)) {
+	m.recordUndo(ctx, func() {
+		if channel, ok := m.channels[name]; ok {
+			channel = cloneChannel(channel)
+			undo(&channel)
+			m.channels[name] = channel
+		}
+	})
+}
+
+func (m *memoryStore) CreateUser(ctx context.Context, user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user.ID = primitive.NewObjectID().Hex()
+	m.users[user.Username] = cloneUser(user)
+	m.recordUndo(ctx, func() { delete(m.users, user.Username) })
+
+	return nil
+}
+
+func (m *memoryStore) GetUser(ctx context.Context, username string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[username]
+	if !ok {
+		return User{}, errNotFound
+	}
+
+	return cloneUser(user), nil
+}
+
+func (m *memoryStore) UpdateUserVotes(ctx context.Context, user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.users[user.Username]
+	if !ok || old.ID != user.ID {
+		return errNotFound
+	}
+	updated := old
+	updated.Upvoted = cloneSet(user.Upvoted)
+	updated.Downvoted = cloneSet(user.Downvoted)
+	m.users[user.Username] = updated
+	m.recordUserUndo(ctx, user.Username, func(user *User) {
+		user.Upvoted = cloneSet(old.Upvoted)
+		user.Downvoted = cloneSet(old.Downvoted)
+	})
+
+	return nil
+}
+
+func (m *memoryStore) AddUserRole(ctx context.Context, username string, role Role) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.users[username]
+	if !ok {
+		return false, errNotFound
+	}
+	for _, r := range old.Roles {
+		if r == role {
+			return false, nil
+		}
+	}
+	updated := old
+	updated.Roles = append(append([]Role{}, old.Roles...), role)
+	m.users[username] = updated
+	m.recordUserUndo(ctx, username, func(user *User) { user.Roles = withoutRole(user.Roles, role) })
+
+	return true, nil
+}
+
+func (m *memoryStore) RemoveUserRole(ctx context.Context, username string, role Role) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.users[username]
+	if !ok {
+		return false, errNotFound
+	}
+	roles := withoutRole(old.Roles, role)
+	if len(roles) == len(old.Roles) {
+		return false, nil
+	}
+	updated := old
+	updated.Roles = roles
+	m.users[username] = updated
+	m.recordUserUndo(ctx, username, func(user *User) {
+		user.Roles = append(withoutRole(user.Roles, role), role)
+	})
+
+	return true, nil
+}
+
+func (m *memoryStore) SetUserBanned(ctx context.Context, username string, banned bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.users[username]
+	if !ok {
+		return errNotFound
+	}
+	updated := old
+	updated.Banned = banned
+	m.users[username] = updated
+	m.recordUserUndo(ctx, username, func(user *User) { user.Banned = old.Banned })
+
+	return nil
+}
+
+func (m *memoryStore) SetUserMutedUntil(ctx context.Context, username string, until *time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.users[username]
+	if !ok {
+		return errNotFound
+	}
+	updated := cloneUser(old)
+	updated.MutedUntil = nil
+	if until != nil {
+		mutedUntil := *until
+		updated.MutedUntil = &mutedUntil
+	}
+	m.users[username] = updated
+	m.recordUserUndo(ctx, username, func(user *User) { user.MutedUntil = old.MutedUntil })
+
+	return nil
+}
+
+func (m *memoryStore) CreateModerationAction(ctx context.Context, action ModerationAction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	action.ID = primitive.NewObjectID().Hex()
+	m.moderationActions = append(m.moderationActions, action)
+	m.recordUndo(ctx, func() {
+		// Actions recorded outside the transaction since may follow it.
+		for i, a := range m.moderationActions {
+			if a.ID == action.ID {
+				m.moderationActions = append(m.moderationActions[:i:i], m.moderationActions[i+1:]...)
+				break
+			}
+		}
+	})
+
+	return nil
+}
+
+func (m *memoryStore) GetModerationActions(ctx context.Context, username string, limit int) ([]ModerationAction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	actions := []ModerationAction{}
+	for i := len(m.moderationActions) - 1; i >= 0 && len(actions) < limit; i-- {
+		if action := m.moderationActions[i]; username == "" || action.Target == username {
+			actions = append(actions, action)
+		}
+	}
+
+	return actions, nil
+}
+
+func (m *memoryStore) RemoveVotes(ctx context.Context, ids []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for username, old := range m.users {
+		username, old := username, old
+		updated := cloneUser(old)
+		for _, id := range ids {
+			delete(updated.Upvoted, id)
+			delete(updated.Downvoted, id)
+		}
+		if len(updated.Upvoted) == len(old.Upvoted) && len(updated.Downvoted) == len(old.Downvoted) {
+			continue
+		}
+		m.users[username] = updated
+		m.recordUserUndo(ctx, username, func(user *User) {
+			for _, id := range ids {
+				if _, ok := old.Upvoted[id]; ok {
+					user.Upvoted[id] = struct{}{}
+				}
+				if _, ok := old.Downvoted[id]; ok {
+					user.Downvoted[id] = struct{}{}
+				}
+			}
+		})
+	}
+
+	return nil
+}
+
+func (m *memoryStore) CreateRefreshToken(ctx context.Context, token RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.refreshTokens[token.ID] = token
+	m.recordUndo(ctx, func() { delete(m.refreshTokens, token.ID) })
+
+	return nil
+}
+
+func (m *memoryStore) UseRefreshToken(ctx context.Context, id string, used time.Time) (RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.refreshTokens[id]
+	if !ok {
+		return RefreshToken{}, errNotFound
+	}
+	if old.Used == nil {
+		updated := old
+		updated.Used = &used
+		m.refreshTokens[id] = updated
+		m.recordUndo(ctx, func() {
+			if token, ok := m.refreshTokens[id]; ok {
+				token.Used = nil
+				m.refreshTokens[id] = token
+			}
+		})
+	}
+
+	return old, nil
+}
+
+func (m *memoryStore) RevokeRefreshTokenFamily(ctx context.Context, family string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, token := range m.refreshTokens {
+		if token.Family != family {
+			continue
+		}
+		delete(m.refreshTokens, id)
+
+		id, token := id, token
+		m.recordUndo(ctx, func() { m.refreshTokens[id] = token })
+	}
+
+	return nil
+}
+
+func (m *memoryStore) GetUserSessions(ctx context.Context, username string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	families := map[string]struct{}{}
+	for _, token := range m.refreshTokens {
+		if token.Username == username {
+			families[token.Family] = struct{}{}
+		}
+	}
+	sessions := make([]string, 0, len(families))
+	for family := range families {
+		sessions = append(sessions, family)
+	}
+
+	return sessions, nil
+}
+
+func (m *memoryStore) RevokeTokens(ctx context.Context, ids []string, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Forget revocations of tokens that have expired anyway.
+	now := time.Now()
+	for id, revocationExpires := range m.revokedTokens {
+		if now.After(revocationExpires) {
+			delete(m.revokedTokens, id)
+		}
+	}
+
+	for _, id := range ids {
+		old, ok := m.revokedTokens[id]
+		m.revokedTokens[id] = expires
+
+		id := id
+		m.recordUndo(ctx, func() {
+			if ok {
+				m.revokedTokens[id] = old
+			} else {
+				delete(m.revokedTokens, id)
+			}
+		})
+	}
+
+	return nil
+}
+
+func (m *memoryStore) AreTokensRevoked(ctx context.Context, ids []string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range ids {
+		if _, ok := m.revokedTokens[id]; ok {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (m *memoryStore) NextSequence(ctx context.Context, stream string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.sequences[stream]
+	m.sequences[stream] = old + 1
+	m.recordUndo(ctx, func() {
+		if ok {
+			m.sequences[stream] = old
+		} else {
+			delete(m.sequences, stream)
+		}
+	})
+
+	return old + 1, nil
+}
+
+func (m *memoryStore) GetSequence(ctx context.Context, stream string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.sequences[stream], nil
+}
+
+func (m *memoryStore) SaveStreamEvent(ctx context.Context, event StreamEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Forget events that are too old to be replayed.
+	events := m.streamEvents[event.Stream]
+	cutoff := time.Now().Add(-m.replayRetention)
+	i := sort.Search(len(events), func(i int) bool { return events[i].Created.After(cutoff) })
+	events = events[i:]
+
+	// Keep events in order of sequence number, although they may be saved
+	// in another order.
+	j := sort.Search(len(events), func(j int) bool { return events[j].Seq > event.Seq })
+	events = append(events, StreamEvent{})
+	copy(events[j+1:], events[j:])
+	events[j] = event
+	m.streamEvents[event.Stream] = events
+	m.recordUndo(ctx, func() {
+		events := []StreamEvent{}
+		for _, e := range m.streamEvents[event.Stream] {
+			if e.Seq != event.Seq {
+				events = append(events, e)
+			}
+		}
+		m.streamEvents[event.Stream] = events
+	})
+
+	return nil
+}
+
+func (m *memoryStore) GetStreamEvents(ctx context.Context, stream string, after int64, limit int) ([]StreamEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	events := m.streamEvents[stream]
+	i := sort.Search(len(events), func(i int) bool { return events[i].Seq > after })
+	events = events[i:]
+	if len(events) > limit {
+		events = events[:limit]
+	}
+
+	return append([]StreamEvent{}, events...), nil
+}
+
+func (m *memoryStore) GetMessages(ctx context.Context, query MessageQuery) ([]Message, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages := []Message{}
+	for _, message := range m.messages {
+		if message.ParentID != query.ParentID {
+			continue
+		}
+		if query.ParentID == "" && (message.Channel != query.Channel || message.Conversation != query.Conversation) {
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	messages, more := paginate(messages, query.Before, query.After, query.Limit)
+	return messages, more, nil
+}
+
+func (m *memoryStore) SearchMessages(ctx context.Context, query SearchQuery) ([]Message, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Narrow the candidates down to the messages containing every token.
+	tokens := append([]string{}, query.Terms...)
+	for _, phrase := range query.Phrases {
+		tokens = append(tokens, tokenize(phrase.Text)...)
+	}
+	var candidates map[string]struct{}
+	for _, token := range tokens {
+		matches := map[string]struct{}{}
+		for id := range m.index[token] {
+			if _, ok := candidates[id]; ok || candidates == nil {
+				matches[id] = struct{}{}
+			}
+		}
+		candidates = matches
+	}
+
+	messages := []Message{}
+	for id, message := range m.messages {
+		if _, ok := candidates[id]; !ok && candidates != nil {
+			continue
+		}
+		if message.Deleted != nil || !query.matches(message) {
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	messages, more := paginate(messages, query.Before, query.After, query.Limit)
+	return messages, more, nil
+}
+
+func (m *memoryStore) GetMessage(ctx context.Context, id string) (Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	message, ok := m.messages[id]
+	if !ok {
+		return Message{}, errNotFound
+	}
+
+	return message, nil
+}
+
+func (m *memoryStore) CreateMessage(ctx context.Context, message Message) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	message.ID = primitive.NewObjectID().Hex()
+	m.messages[message.ID] = message
+	m.recordUndo(ctx, func() { delete(m.messages, message.ID) })
+	m.reindex(ctx, message.ID, "", message.Content)
+
+	return message.ID, nil
+}
+
+func (m *memoryStore) EditMessage(ctx context.Context, id string, content string, edited time.Time) (Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.messages[id]
+	if !ok || old.Deleted != nil {
+		return Message{}, errNotFound
+	}
+	revision := Revision{Content: old.Content, Created: old.Created}
+	if old.Edited != nil {
+		revision.Created = *old.Edited
+	}
+	updated := old
+	updated.Revisions = append(append([]Revision{}, old.Revisions...), revision)
+	updated.Content = content
+	updated.Edited = &edited
+	m.messages[id] = updated
+	m.recordMessageUndo(ctx, id, func(message *Message) {
+		message.Content = old.Content
+		message.Revisions = old.Revisions
+		message.Edited = old.Edited
+	})
+	m.reindex(ctx, id, old.Content, content)
+
+	return updated, nil
+}
+
+func (m *memoryStore) DeleteMessage(ctx context.Context, id string, deletedBy string, deleted time.Time) (Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.messages[id]
+	if !ok {
+		return Message{}, errNotFound
+	}
+	updated := old
+	updated.Content = ""
+	updated.Revisions = nil
+	updated.Reactions = nil
+	updated.Deleted = &deleted
+	updated.DeletedBy = deletedBy
+	m.messages[id] = updated
+	m.recordMessageUndo(ctx, id, func(message *Message) {
+		message.Content = old.Content
+		message.Revisions = old.Revisions
+		message.Reactions = cloneReactions(old.Reactions)
+		message.Deleted = old.Deleted
+		message.DeletedBy = old.DeletedBy
+	})
+	m.reindex(ctx, id, old.Content, "")
+
+	return updated, nil
+}
+
+func (m *memoryStore) PurgeMessages(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	purged := []string{}
+	for id, message := range m.messages {
+		if message.Deleted == nil || !message.Deleted.Before(deletedBefore) {
+			continue
+		}
+		delete(m.messages, id)
+		purged = append(purged, id)
+
+		message := message
+		m.recordUndo(ctx, func() { m.messages[message.ID] = message })
+	}
+
+	return purged, nil
+}
+
+func (m *memoryStore) AddReply(ctx context.Context, id string, replied time.Time) (Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.messages[id]
+	if !ok {
+		return Message{}, errNotFound
+	}
+	updated := old
+	updated.ReplyCount++
+	if old.LastReply == nil || replied.After(*old.LastReply) {
+		updated.LastReply = &replied
+	}
+	m.messages[id] = updated
+	m.recordMessageUndo(ctx, id, func(message *Message) {
+		message.ReplyCount--
+		if message.LastReply == updated.LastReply {
+			message.LastReply = old.LastReply
+		}
+	})
+
+	return updated, nil
+}
+
+func (m *memoryStore) AddReaction(ctx context.Context, id string, emoji string, username string) (Message, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.messages[id]
+	if !ok {
+		return Message{}, false, errNotFound
+	}
+	for _, user := range old.Reactions[emoji] {
+		if user == username {
+			return old, false, nil
+		}
+	}
+	updated := old
+	updated.Reactions = cloneReactions(old.Reactions)
+	updated.Reactions[emoji] = append(updated.Reactions[emoji], username)
+	m.messages[id] = updated
+	m.recordMessageUndo(ctx, id, func(message *Message) { removeReaction(message.Reactions, emoji, username) })
+
+	return updated, true, nil
+}
+
+func (m *memoryStore) RemoveReaction(ctx context.Context, id string, emoji string, username string) (Message, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.messages[id]
+	if !ok {
+		return Message{}, false, errNotFound
+	}
+	updated := old
+	updated.Reactions = cloneReactions(old.Reactions)
+	if !removeReaction(updated.Reactions, emoji, username) {
+		return old, false, nil
+	}
+	m.messages[id] = updated
+	m.recordMessageUndo(ctx, id, func(message *Message) {
+		removeReaction(message.Reactions, emoji, username)
+		message.Reactions[emoji] = append(message.Reactions[emoji], username)
+	})
+
+	return updated, true, nil
+}
+
+func (m *memoryStore) UpdateMessageVotes(ctx context.Context, id string, n int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.messages[id]
+	if !ok {
+		return errNotFound
+	}
+	updated := old
+	updated.Votes += n
+	m.messages[id] = updated
+	m.recordMessageUndo(ctx, id, func(message *Message) { message.Votes -= n })
+
+	return nil
+}
+
+func (m *memoryStore) SetReadMarker(ctx context.Context, marker ReadMarker) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := readMarkerKey{username: marker.Username, target: marker.Target}
+	old, ok := m.readMarkers[key]
+	if ok && old.cursor().compare(Message{ID: marker.MessageID, Created: marker.MessageCreated}) <= 0 {
+		return false, nil
+	}
+	m.readMarkers[key] = marker
+	m.recordUndo(ctx, func() {
+		if ok {
+			m.readMarkers[key] = old
+		} else {
+			delete(m.readMarkers, key)
+		}
+	})
+
+	return true, nil
+}
+
+func (m *memoryStore) GetReadMarker(ctx context.Context, username string, target Target) (ReadMarker, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	marker, ok := m.readMarkers[readMarkerKey{username: username, target: target}]
+	if !ok {
+		return ReadMarker{}, errNotFound
+	}
+
+	return marker, nil
+}
+
+func (m *memoryStore) CountUnread(ctx context.Context, username string, target Target, after *messageCursor) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+	for _, message := range m.messages {
+		if message.ParentID != "" || message.Deleted != nil || message.Author == username || message.target() != target {
+			continue
+		}
+		if after != nil && after.compare(message) <= 0 {
+			continue
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+func (m *memoryStore) CreateChannel(ctx context.Context, channel Channel) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.channels[channel.Name]; ok {
+		return errAlreadyExists
+	}
+	m.channels[channel.Name] = cloneChannel(channel)
+	m.recordUndo(ctx, func() { delete(m.channels, channel.Name) })
+
+	return nil
+}
+
+func (m *memoryStore) GetChannel(ctx context.Context, name string) (Channel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	channel, ok := m.channels[name]
+	if !ok {
+		return Channel{}, errNotFound
+	}
+
+	return cloneChannel(channel), nil
+}
+
+func (m *memoryStore) GetAllChannels(ctx context.Context) ([]Channel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	channels := make([]Channel, 0, len(m.channels))
+	for _, channel := range m.channels {
+		channels = append(channels, cloneChannel(channel))
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Name < channels[j].Name
+	})
+
+	return channels, nil
+}
+
+func (m *memoryStore) AddChannelMember(ctx context.Context, name string, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.channels[name]
+	if !ok {
+		return errNotFound
+	}
+	if old.hasMember(username) {
+		return nil
+	}
+	updated := cloneChannel(old)
+	updated.Members = append(updated.Members, username)
+	m.channels[name] = updated
+	m.recordChannelUndo(ctx, name, func(channel *Channel) {
+		channel.Members = withoutMember(channel.Members, username)
+	})
+
+	return nil
+}
+
+func (m *memoryStore) RemoveChannelMember(ctx context.Context, name string, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.channels[name]
+	if !ok {
+		return errNotFound
+	}
+	if !old.hasMember(username) {
+		return nil
+	}
+	updated := old
+	updated.Members = withoutMember(old.Members, username)
+	m.channels[name] = updated
+	m.recordChannelUndo(ctx, name, func(channel *Channel) {
+		if !channel.hasMember(username) {
+			channel.Members = append(channel.Members, username)
+		}
+	})
+
+	return nil
+}
+
+func (m *memoryStore) GetUserChannels(ctx context.Context, username string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := []string{}
+	for _, channel := range m.channels {
+		for _, member := range channel.Members {
+			if member == username {
+				names = append(names, channel.Name)
+				break
+			}
+		}
+	}
+
+	return names, nil
+}
+
+func (m *memoryStore) GetOrCreateConversation(ctx context.Context, conversation Conversation) (Conversation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.conversations {
+		if existing.Key == conversation.Key {
+			return cloneConversation(existing), nil
+		}
+	}
+	conversation.ID = primitive.NewObjectID().Hex()
+	m.conversations[conversation.ID] = cloneConversation(conversation)
+	m.recordUndo(ctx, func() { delete(m.conversations, conversation.ID) })
+
+	return conversation, nil
+}
+
+func (m *memoryStore) GetConversation(ctx context.Context, id string) (Conversation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conversation, ok := m.conversations[id]
+	if !ok {
+		return Conversation{}, errNotFound
+	}
+
+	return cloneConversation(conversation), nil
+}
+
+func (m *memoryStore) GetUserConversations(ctx context.Context, username string) ([]Conversation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conversations := []Conversation{}
+	for _, conversation := range m.conversations {
+		if conversation.hasParticipant(username) {
+			conversations = append(conversations, cloneConversation(conversation))
+		}
+	}
+
+	return conversations, nil
+}
+
+func (m *memoryStore) ExecuteAsTransaction(ctx context.Context, f func(ctx context.Context) error) error {
+	// Join the transaction in progress rather than waiting for it to finish.
+	if _, ok := ctx.Value(memoryTxKey{}).(*memoryTx); ok {
+		return f(ctx)
+	}
+
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+
+	tx := &memoryTx{}
+	if err := f(context.WithValue(ctx, memoryTxKey{}, tx)); err != nil {
+		// Roll back writes in reverse order.
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (m *memoryStore) Disconnect(ctx context.Context) error {
+	return nil
+}
+
+// Move a message from the index entries of the tokens of its old content to
+// those of its new content. Must be called with m.mu held.
+func (m *memoryStore) reindex(ctx context.Context, id string, oldContent string, newContent string) {
+	oldTokens, newTokens := tokenize(oldContent), tokenize(newContent)
+	m.updateIndex(id, oldTokens, newTokens)
+	m.recordUndo(ctx, func() { m.updateIndex(id, newTokens, oldTokens) })
+}
+
+// Remove a message from the index entries of removed, then add it to those of
+// added. Must be called with m.mu held.
+func (m *memoryStore) updateIndex(id string, removed []string, added []string) {
+	for _, token := range removed {
+		delete(m.index[token], id)
+		if len(m.index[token]) == 0 {
+			delete(m.index, token)
+		}
+	}
+	for _, token := range added {
+		if m.index[token] == nil {
+			m.index[token] = map[string]struct{}{}
+		}
+		m.index[token][id] = struct{}{}
+	}
+}
+
+// Sort messages into chronological order and return the page of them between
+// the cursors, and whether more messages lie beyond the page.
+func paginate(messages []Message, before *messageCursor, after *messageCursor, limit int) ([]Message, bool) {
+	page := []Message{}
+	for _, message := range messages {
+		if before != nil && before.compare(message) >= 0 {
+			continue
+		}
+		if after != nil && after.compare(message) <= 0 {
+			continue
+		}
+		page = append(page, message)
+	}
+	sortMessages(page)
+
+	more := len(page) > limit
+	if more {
+		if after != nil {
+			page = page[:limit]
+		} else {
+			page = page[len(page)-limit:]
+		}
+	}
+
+	return page, more
+}
+
+// Deep copy a user so callers cannot mutate stored state.
+func cloneUser(user User) User {
+	user.Password = append([]byte(nil), user.Password...)
+	user.Upvoted = cloneSet(user.Upvoted)
+	user.Downvoted = cloneSet(user.Downvoted)
+	user.Roles = append([]Role(nil), user.Roles...)
+	if user.MutedUntil != nil {
+		until := *user.MutedUntil
+		user.MutedUntil = &until
+	}
+	return user
+}
+
+// Deep copy a channel so callers cannot mutate stored state.
+func cloneChannel(channel Channel) Channel {
+	channel.Members = append([]string{}, channel.Members...)
+	return channel
+}
+
+// Deep copy a conversation so callers cannot mutate stored state.
+func cloneConversation(conversation Conversation) Conversation {
+	conversation.Participants = append([]string{}, conversation.Participants...)
+	return conversation
+}
+
+// Deep copy the reactions to a message so that stored state is never mutated
+// in place.
+func cloneReactions(reactions Reactions) Reactions {
+	clone := make(Reactions, len(reactions))
+	for emoji, users := range reactions {
+		clone[emoji] = append([]string{}, users...)
+	}
+	return clone
+}
+
+// Return a copy of roles without role.
+func withoutRole(roles []Role, role Role) []Role {
+	kept := []Role{}
+	for _, r := range roles {
+		if r != role {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// Return a copy of members without username.
+func withoutMember(members []string, username string) []string {
+	kept := []string{}
+	for _, member := range members {
+		if member != username {
+			kept = append(kept, member)
+		}
+	}
+	return kept
+}
+
+// Remove a user's reaction in place, returning whether they had reacted.
+func removeReaction(r Reactions, emoji string, username string) bool {
+	users := []string{}
+	for _, user := range r[emoji] {
+		if user != username {
+			users = append(users, user)
+		}
+	}
+	if len(users) == len(r[emoji]) {
+		return false
+	}
+	if len(users) > 0 {
+		r[emoji] = users
+	} else {
+		delete(r, emoji)
+	}
+	return true
+}
+
+// Copy a set of IDs.
+func cloneSet(set map[string]struct{}) map[string]struct{} {
+	clone := make(map[string]struct{}, len(set))
+	for k := range set {
+		clone[k] = struct{}{}
+	}
+	return clone
+}
@@ -2,67 +2,155 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"io"
 	"log"
 	"net/http"
 	"sort"
 	"time"
 
 	"github.com/gorilla/mux"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // Representation of a message in the database and over the wire.
 type Message struct {
-	ID      string    `bson:"_id,omitempty" json:"id"`
-	Author  string    `bson:"author" json:"author"`
+	ID      string `bson:"_id,omitempty" json:"id"`
+	Author  string `bson:"author" json:"author"`
+	Channel string `bson:"channel" json:"channel,omitempty"`
+
+	// ID of the direct message conversation the message belongs to, if any.
+	Conversation string `bson:"conversation,omitempty" json:"conversation,omitempty"`
+
 	Content string    `bson:"content" json:"content"`
 	Votes   int       `json:"votes"`
 	Created time.Time `bson:"created" json:"created"`
+
+	// Time of the latest edit, if the message has been edited.
+	Edited *time.Time `bson:"edited,omitempty" json:"edited,omitempty"`
+
+	// Prior contents of the message, oldest first. Only exposed through the
+	// revisions endpoint.
+	Revisions []Revision `bson:"revisions,omitempty" json:"-"`
+
+	// Time the message was deleted. Deleted messages are kept as tombstones,
+	// with their content cleared, until they are purged.
+	Deleted *time.Time `bson:"deleted,omitempty" json:"deleted,omitempty"`
+
+	// Username of the author or moderator who deleted the message, if deleted.
+	DeletedBy string `bson:"deletedBy,omitempty" json:"deletedBy,omitempty"`
+
+	// ID of the message this is a reply to, if any.
+	ParentID string `bson:"parentID,omitempty" json:"parentID,omitempty"`
+
+	// Number of replies to the message.
+	ReplyCount int `bson:"replyCount,omitempty" json:"replyCount,omitempty"`
+
+	// Time of the latest reply to the message, if any.
+	LastReply *time.Time `bson:"lastReply,omitempty" json:"lastReply,omitempty"`
+
+	// Emoji reactions to the message.
+	Reactions Reactions `bson:"reactions,omitempty" json:"reactions,omitempty"`
+}
+
+// Return the channel or conversation the message was posted to.
+func (m Message) target() Target {
+	target := Target{Channel: m.Channel, Conversation: m.Conversation}
+	if target == (Target{}) {
+		// Messages from before channels existed belong to the default channel.
+		target.Channel = defaultChannel
+	}
+	return target
 }
 
-// Endpoint for getting all messages in chat.
+// Endpoint for getting a page of messages in a channel (the default channel
+// unless the channel query parameter is given).
 func handleGetAllMessages(s *Server, w http.ResponseWriter, r *http.Request) {
-	log.Println("Getting all messages in chat.")
+	query := MessageQuery{Target: Target{Channel: r.URL.Query().Get("channel")}}
+	if query.Channel == "" {
+		query.Channel = defaultChannel
+	}
+	log.Printf("Getting messages in channel %v.\n", query.Channel)
 
-	messagesCollection := s.db.Collection("messages")
-	cursor, err := messagesCollection.Find(s.ctx, bson.D{})
-	if err != nil {
-		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := s.ensureChannelMember(query.Channel, r.Header.Get("username")); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.parsePageParameters(r, &query); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	messages := []Message{}
-	if err := cursor.All(s.ctx, &messages); err != nil {
-		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	page, err := s.getMessagePage(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.addUnreadCount(&page, r.Header.Get("username"), query.Target); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	sort.Slice(messages, func(i, j int) bool {
-		return messages[i].Created.Before(messages[j].Created)
-	})
+	writeJSON(w, http.StatusOK, page)
+}
 
-	serialized, err := json.Marshal(messages)
+// Get a message, or a non-nil error unless the user can see the channel or
+// conversation it was posted to.
+func (s *Server) getVisibleMessage(id string, username string) (Message, error) {
+	message, err := s.store.GetMessage(s.ctx, id)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		if err == errNotFound {
+			return Message{}, newAPIError(http.StatusNotFound, "No message with given ID.")
+		}
+		return Message{}, err
 	}
 
-	// TODO: Set Content-Type = application/json?
-	if _, err := w.Write(serialized); err != nil {
-		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	target := message.target()
+	if err := s.ensureTargetAccess(username, &target); err != nil {
+		return Message{}, err
+	}
+
+	return message, nil
+}
+
+// Get a message like getVisibleMessage, but return a non-nil error if it has
+// been deleted.
+func (s *Server) getLiveMessage(id string, username string) (Message, error) {
+	message, err := s.getVisibleMessage(id, username)
+	if err != nil {
+		return Message{}, err
+	}
+	if message.Deleted != nil {
+		return Message{}, newAPIError(http.StatusGone, "Message has been deleted.")
+	}
+
+	return message, nil
+}
+
+// Sort messages into chronological order.
+func sortMessages(messages []Message) {
+	sort.Slice(messages, func(i, j int) bool {
+		return cursorFor(messages[j]).compare(messages[i]) < 0
+	})
+}
+
+// Reverse the order of messages in place.
+func reverseMessages(messages []Message) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
 	}
 }
 
 // Body of request to the create message endpoint.
 type CreateMessageRequestBody struct {
 	Content string `json:"content"`
+
+	// Where to post the message. Defaults to the default channel, or, for
+	// replies, the channel or conversation of the parent.
+	Target
+
+	// ID of the message to reply to, if any.
+	ParentID string `json:"parentID"`
 }
 
 // Endpoint for creating a new message.
@@ -76,33 +164,81 @@ func handleCreateMessage(s *Server, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Add message to database.
-	messagesCollection := s.db.Collection("messages")
+	// TODO: maybe add nil check for username header.
+	if _, err := s.createMessage(r.Header.Get("username"), body); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Post a message on behalf of the given user and broadcast it on the websocket.
+func (s *Server) createMessage(username string, body CreateMessageRequestBody) (Message, error) {
+	if err := s.ensureNotMuted(username); err != nil {
+		return Message{}, err
+	}
+	if body.ParentID != "" {
+		parent, err := s.getLiveMessage(body.ParentID, username)
+		if err != nil {
+			return Message{}, err
+		}
+		if parent.ParentID != "" {
+			return Message{}, newAPIError(http.StatusBadRequest, "Cannot reply to a reply.")
+		}
+		if body.Target != (Target{}) && body.Target != parent.target() {
+			return Message{}, newAPIError(http.StatusBadRequest, "Replies must be posted to the channel or conversation of the parent.")
+		}
+		body.Target = parent.target()
+	}
+	if err := s.ensureTargetAccess(username, &body.Target); err != nil {
+		return Message{}, err
+	}
+
+	// Add message to database, updating the reply count of the parent.
 	message := Message{
-		// TODO: maybe add nil check for username header.
-		Author:  r.Header.Get("username"),
-		Content: body.Content,
-		Votes:   0,
-		Created: time.Now(),
+		Author:       username,
+		Channel:      body.Channel,
+		Conversation: body.Conversation,
+		Content:      body.Content,
+		Votes:        0,
+		Created:      time.Now(),
+		ParentID:     body.ParentID,
 	}
-	insertResult, err := messagesCollection.InsertOne(s.ctx, message)
+	var parent Message
+	err := s.store.ExecuteAsTransaction(s.ctx, func(ctx context.Context) error {
+		id, err := s.store.CreateMessage(ctx, message)
+		if err != nil {
+			return err
+		}
+		message.ID = id
+
+		if message.ParentID != "" {
+			parent, err = s.store.AddReply(ctx, message.ParentID, message.Created)
+		}
+		return err
+	})
 	if err != nil {
-		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return Message{}, err
 	}
 
-	// Broadcast message on websocket.
-	message.ID = insertResult.InsertedID.(primitive.ObjectID).Hex()
-	serialized, err := json.Marshal(message)
-	if err != nil {
+	// Broadcast message on websocket. Sending a message ends the author's
+	// typing indicator. The message is already saved, so failing to broadcast
+	// it must not fail the request, or clients would post it again.
+	if err := s.broadcastEvent(message, eventMessageCreated, message); err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
 	}
-	s.hub.broadcast <- serialized
+	if message.ParentID == "" {
+		s.typing.stop(username, message.target())
+	}
+	if message.ParentID != "" {
+		payload := ThreadUpdatedPayload{ID: parent.ID, ReplyCount: parent.ReplyCount, LastReply: parent.LastReply}
+		if err := s.broadcastEvent(parent, eventThreadUpdated, payload); err != nil {
+			log.Println(err)
+		}
+	}
 
-	w.WriteHeader(http.StatusNoContent)
+	return message, nil
 }
 
 // Body of request to the update message endpoint.
@@ -111,14 +247,31 @@ type UpdateMessageRequestBody struct {
 	Downvoted bool `json:"downvoted"`
 }
 
-// Endpoint for updating the vote count of a message.
+// Endpoint for updating a message. Requests with a content field edit the
+// message; all others update its vote count.
 func handleUpdateMessage(s *Server, w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 	log.Printf("Updating message with ID: %v\n", id)
 
 	// Deserialize request.
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var edit EditMessageRequestBody
+	if err := json.Unmarshal(raw, &edit); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if edit.Content != nil {
+		handleEditMessage(s, w, r, id, *edit.Content)
+		return
+	}
 	var body UpdateMessageRequestBody
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+	if err := json.Unmarshal(raw, &body); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -127,24 +280,28 @@ func handleUpdateMessage(s *Server, w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "upvoted and downvoted cannot both be true", http.StatusBadRequest)
 		return
 	}
+	username := r.Header.Get("username")
+	if _, err := s.getLiveMessage(id, username); err != nil {
+		writeError(w, err)
+		return
+	}
 
 	// Update vote.
-	var err error
-	username := r.Header.Get("username")
+	var upvoteChanged, downvoteChanged bool
 	if body.Upvoted {
-		err = s.addUpvote(username, id)
+		upvoteChanged, err = s.addUpvote(username, id)
 	} else {
-		err = s.removeUpvote(username, id)
+		upvoteChanged, err = s.removeUpvote(username, id)
 	}
 	if err == nil {
 		if body.Downvoted {
-			err = s.addDownvote(username, id)
+			downvoteChanged, err = s.addDownvote(username, id)
 		} else {
-			err = s.removeDownvote(username, id)
+			downvoteChanged, err = s.removeDownvote(username, id)
 		}
 	}
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if err == errNotFound {
 			log.Println(err)
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
@@ -152,15 +309,33 @@ func handleUpdateMessage(s *Server, w http.ResponseWriter, r *http.Request) {
 
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Stream the new vote count to other clients.
+	if upvoteChanged || downvoteChanged {
+		message, err := s.store.GetMessage(s.ctx, id)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		payload := VoteUpdatedPayload{ID: message.ID, Votes: message.Votes}
+		if err := s.broadcastEvent(message, eventVoteUpdated, payload); err != nil {
+			log.Println(err)
+		}
 	}
 
 	log.Printf("successfully updated message %v with upvoted %v and downvoted %v\n", id, body.Upvoted, body.Downvoted)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// Upvote a message (idempotent operation).
-func (s Server) addUpvote(username string, id string) error {
-	return s.executeAsTransaction(func() error {
-		user, err := s.getUser(username)
+// Upvote a message (idempotent operation). Returns whether the vote changed.
+func (s Server) addUpvote(username string, id string) (bool, error) {
+	var changed bool
+	err := s.store.ExecuteAsTransaction(s.ctx, func(ctx context.Context) error {
+		changed = false
+		user, err := s.store.GetUser(ctx, username)
 		if err != nil {
 			return err
 		}
@@ -170,21 +345,27 @@ func (s Server) addUpvote(username string, id string) error {
 		}
 		user.Upvoted[id] = struct{}{}
 
-		if err := s.updateMessageVotes(id, 1); err != nil {
+		if err := s.store.UpdateMessageVotes(ctx, id, 1); err != nil {
 			return err
 		}
-		if err := s.updateUserVotes(user); err != nil {
+		if err := s.store.UpdateUserVotes(ctx, user); err != nil {
 			return err
 		}
 
+		changed = true
 		return nil
 	})
+
+	return changed, err
 }
 
-// Remove an upvote from a message (idempotent operation).
-func (s Server) removeUpvote(username string, id string) error {
-	return s.executeAsTransaction(func() error {
-		user, err := s.getUser(username)
+// Remove an upvote from a message (idempotent operation). Returns whether the
+// vote changed.
+func (s Server) removeUpvote(username string, id string) (bool, error) {
+	var changed bool
+	err := s.store.ExecuteAsTransaction(s.ctx, func(ctx context.Context) error {
+		changed = false
+		user, err := s.store.GetUser(ctx, username)
 		if err != nil {
 			return err
 		}
@@ -194,21 +375,26 @@ func (s Server) removeUpvote(username string, id string) error {
 		}
 		delete(user.Upvoted, id)
 
-		if err := s.updateMessageVotes(id, -1); err != nil {
+		if err := s.store.UpdateMessageVotes(ctx, id, -1); err != nil {
 			return err
 		}
-		if err := s.updateUserVotes(user); err != nil {
+		if err := s.store.UpdateUserVotes(ctx, user); err != nil {
 			return err
 		}
 
+		changed = true
 		return nil
 	})
+
+	return changed, err
 }
 
-// Downvote a message (idempotent operation).
-func (s Server) addDownvote(username string, id string) error {
-	return s.executeAsTransaction(func() error {
-		user, err := s.getUser(username)
+// Downvote a message (idempotent operation). Returns whether the vote changed.
+func (s Server) addDownvote(username string, id string) (bool, error) {
+	var changed bool
+	err := s.store.ExecuteAsTransaction(s.ctx, func(ctx context.Context) error {
+		changed = false
+		user, err := s.store.GetUser(ctx, username)
 		if err != nil {
 			return err
 		}
@@ -218,21 +404,27 @@ func (s Server) addDownvote(username string, id string) error {
 		}
 		user.Downvoted[id] = struct{}{}
 
-		if err := s.updateMessageVotes(id, -1); err != nil {
+		if err := s.store.UpdateMessageVotes(ctx, id, -1); err != nil {
 			return err
 		}
-		if err := s.updateUserVotes(user); err != nil {
+		if err := s.store.UpdateUserVotes(ctx, user); err != nil {
 			return err
 		}
 
+		changed = true
 		return nil
 	})
+
+	return changed, err
 }
 
-// Remove a downvote from a message (idempotent operation).
-func (s Server) removeDownvote(username string, id string) error {
-	return s.executeAsTransaction(func() error {
-		user, err := s.getUser(username)
+// Remove a downvote from a message (idempotent operation). Returns whether the
+// vote changed.
+func (s Server) removeDownvote(username string, id string) (bool, error) {
+	var changed bool
+	err := s.store.ExecuteAsTransaction(s.ctx, func(ctx context.Context) error {
+		changed = false
+		user, err := s.store.GetUser(ctx, username)
 		if err != nil {
 			return err
 		}
@@ -242,71 +434,16 @@ func (s Server) removeDownvote(username string, id string) error {
 		}
 		delete(user.Downvoted, id)
 
-		if err := s.updateMessageVotes(id, 1); err != nil {
+		if err := s.store.UpdateMessageVotes(ctx, id, 1); err != nil {
 			return err
 		}
-		if err := s.updateUserVotes(user); err != nil {
+		if err := s.store.UpdateUserVotes(ctx, user); err != nil {
 			return err
 		}
 
+		changed = true
 		return nil
 	})
-}
-
-func (s Server) getUser(username string) (User, error) {
-	var user User
-	if err := s.users.FindOne(s.ctx, bson.M{"username": username}).Decode(&user); err != nil {
-		log.Println(err)
-		return User{}, err
-	}
-
-	return user, nil
-}
-
-// Updates the vote count of the given message by n in the database.
-func (s Server) updateMessageVotes(id string, n int) error {
-	objectID, _ := primitive.ObjectIDFromHex(id)
-	filter := bson.D{{"_id", objectID}}
-	update := bson.M{"$inc": bson.M{"votes": n}}
-	if err := s.messages.FindOneAndUpdate(s.ctx, filter, update).Err(); err != nil {
-		log.Println(err)
-		return err
-	}
-
-	return nil
-}
-
-// Updates the voted and downvoted messages for the given user in the database.
-func (s Server) updateUserVotes(user User) error {
-	objectID, _ := primitive.ObjectIDFromHex(user.ID)
-	filter := bson.D{{"_id", objectID}}
-	update := bson.M{
-		"$set": bson.M{
-			"upvoted":   user.Upvoted,
-			"downvoted": user.Downvoted,
-		},
-	}
-	if err := s.users.FindOneAndUpdate(s.ctx, filter, update).Err(); err != nil {
-		log.Println("error updating user")
-		return err
-	}
-
-	return nil
-}
-
-// Execute the given database code as a transaction.
-func (s Server) executeAsTransaction(f func() error) error {
-	session, err := s.dbClient.StartSession()
-	if err != nil {
-		return err
-	}
-	defer session.EndSession(s.ctx)
-
-	// TODO: If this will be executed in multiple goroutines, protect w/ mutex.
-	// See: https://www.mongodb.com/docs/drivers/go/current/fundamentals/transactions/.
-	_, err = session.WithTransaction(s.ctx, func(ctx mongo.SessionContext) (interface{}, error) {
-		return nil, f()
-	})
 
-	return err
+	return changed, err
 }
@@ -0,0 +1,301 @@
+// Routes for moderators to ban and mute users and remove their messages, and
+// the log of moderation actions.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Types of moderation actions.
+const (
+	actionBan           = "ban"
+	actionUnban         = "unban"
+	actionMute          = "mute"
+	actionUnmute        = "unmute"
+	actionRemoveMessage = "remove_message"
+)
+
+// A record of an action taken by a moderator, in the database and over the
+// wire.
+type ModerationAction struct {
+	ID   string `bson:"_id,omitempty" json:"id"`
+	Type string `bson:"type" json:"type"`
+
+	// Username of the user acted against, or of the author of the removed
+	// message.
+	Target string `bson:"target" json:"target"`
+
+	// ID of the removed message, for remove_message actions.
+	MessageID string `bson:"messageID,omitempty" json:"messageID,omitempty"`
+
+	// Username of the moderator who took the action.
+	Actor string `bson:"actor" json:"actor"`
+
+	Reason  string    `bson:"reason" json:"reason"`
+	Created time.Time `bson:"created" json:"created"`
+
+	// When a mute ends, for mute actions.
+	Until *time.Time `bson:"until,omitempty" json:"until,omitempty"`
+}
+
+// Body of requests to the moderation endpoints.
+type ModerationRequestBody struct {
+	Reason string `json:"reason"`
+
+	// When a mute ends. Only used when muting.
+	Until *time.Time `json:"until"`
+}
+
+// Return whether the user is muted at the given time.
+func (u User) isMuted(now time.Time) bool {
+	return u.MutedUntil != nil && now.Before(*u.MutedUntil)
+}
+
+// Return an error if the user may not post messages.
+func (s *Server) ensureNotMuted(username string) error {
+	user, err := s.store.GetUser(s.ctx, username)
+	if err != nil {
+		return err
+	}
+	if user.isMuted(time.Now()) {
+		return newAPIError(http.StatusForbidden, "Muted until "+user.MutedUntil.Format(time.RFC3339)+".")
+	}
+
+	return nil
+}
+
+// Return an error unless the actor may moderate the target user. Users cannot
+// moderate themselves, and only admins can moderate moderators.
+func (s *Server) ensureCanModerate(actor AccessClaims, target string) error {
+	user, err := s.store.GetUser(s.ctx, target)
+	if err != nil {
+		if err == errNotFound {
+			return newAPIError(http.StatusNotFound, "User not found.")
+		}
+		return err
+	}
+	if target == actor.Username {
+		return newAPIError(http.StatusBadRequest, "Cannot moderate yourself.")
+	}
+	if hasPermission(allRoles(user.Roles), permModerate) && !hasPermission(actor.Roles, permManageRoles) {
+		return newAPIError(http.StatusForbidden, "Only admins can moderate moderators.")
+	}
+
+	return nil
+}
+
+// Decode the body of a moderation request, which must give a reason.
+func decodeModerationRequest(r *http.Request) (ModerationRequestBody, error) {
+	var body ModerationRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return ModerationRequestBody{}, newAPIError(http.StatusBadRequest, err.Error())
+	}
+	if body.Reason == "" {
+		return ModerationRequestBody{}, newAPIError(http.StatusBadRequest, "A reason is required.")
+	}
+
+	return body, nil
+}
+
+// Apply a moderation action to the store with update, and record it, in one
+// transaction.
+func (s *Server) recordModerationAction(action ModerationAction, update func(ctx context.Context) error) error {
+	return s.store.ExecuteAsTransaction(s.ctx, func(ctx context.Context) error {
+		if err := update(ctx); err != nil {
+			return err
+		}
+		return s.store.CreateModerationAction(ctx, action)
+	})
+}
+
+// Endpoint for banning a user. Banned users cannot log in or use their
+// existing tokens, and their websocket connections are closed.
+func handleBanUser(s *Server, w http.ResponseWriter, r *http.Request) {
+	handleSetBanned(s, w, r, true)
+}
+
+// Endpoint for lifting a user's ban.
+func handleUnbanUser(s *Server, w http.ResponseWriter, r *http.Request) {
+	handleSetBanned(s, w, r, false)
+}
+
+// Ban or unban the user in the URL. Either way, the user's sessions are
+// revoked, so they have to log in again.
+func handleSetBanned(s *Server, w http.ResponseWriter, r *http.Request, banned bool) {
+	target := mux.Vars(r)["username"]
+	claims := requestClaims(r)
+
+	body, err := decodeModerationRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.ensureCanModerate(claims, target); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	action := ModerationAction{Type: actionUnban, Target: target, Actor: claims.Username, Reason: body.Reason, Created: time.Now()}
+	if banned {
+		action.Type = actionBan
+	}
+	err = s.recordModerationAction(action, func(ctx context.Context) error {
+		return s.store.SetUserBanned(ctx, target, banned)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	sessions, err := s.store.GetUserSessions(s.ctx, target)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.revokeSessions(sessions); err != nil {
+		writeError(w, err)
+		return
+	}
+	if banned {
+		// Sessions whose refresh tokens have expired can still have live
+		// connections.
+		if err := s.hub.publish(BrokerEvent{Disconnect: target}); err != nil {
+			log.Println(err)
+		}
+	}
+
+	log.Printf("%v: %v %v: %v\n", claims.Username, action.Type, target, body.Reason)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Endpoint for muting a user until a deadline. Muted users cannot post
+// messages.
+func handleMuteUser(s *Server, w http.ResponseWriter, r *http.Request) {
+	handleSetMuted(s, w, r, true)
+}
+
+// Endpoint for unmuting a user.
+func handleUnmuteUser(s *Server, w http.ResponseWriter, r *http.Request) {
+	handleSetMuted(s, w, r, false)
+}
+
+// Mute or unmute the user in the URL.
+func handleSetMuted(s *Server, w http.ResponseWriter, r *http.Request, muted bool) {
+	target := mux.Vars(r)["username"]
+	claims := requestClaims(r)
+
+	body, err := decodeModerationRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if muted && (body.Until == nil || !body.Until.After(time.Now())) {
+		http.Error(w, "Mutes must end in the future.", http.StatusBadRequest)
+		return
+	}
+	if err := s.ensureCanModerate(claims, target); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	action := ModerationAction{Type: actionUnmute, Target: target, Actor: claims.Username, Reason: body.Reason, Created: time.Now()}
+	var until *time.Time
+	if muted {
+		action.Type, action.Until, until = actionMute, body.Until, body.Until
+	}
+	err = s.recordModerationAction(action, func(ctx context.Context) error {
+		return s.store.SetUserMutedUntil(ctx, target, until)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	log.Printf("%v: %v %v: %v\n", claims.Username, action.Type, target, body.Reason)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Endpoint for removing another user's message. The message is deleted as if
+// by its author.
+func handleRemoveMessage(s *Server, w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	claims := requestClaims(r)
+
+	body, err := decodeModerationRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	message, err := s.store.GetMessage(s.ctx, id)
+	if err != nil {
+		if err == errNotFound {
+			http.Error(w, "No message with given ID.", http.StatusNotFound)
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	if message.Deleted != nil {
+		http.Error(w, "Message has been deleted.", http.StatusGone)
+		return
+	}
+	if err := s.ensureCanModerate(claims, message.Author); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	action := ModerationAction{
+		Type:      actionRemoveMessage,
+		Target:    message.Author,
+		MessageID: id,
+		Actor:     claims.Username,
+		Reason:    body.Reason,
+		Created:   time.Now(),
+	}
+	err = s.recordModerationAction(action, func(ctx context.Context) error {
+		message, err = s.store.DeleteMessage(ctx, id, claims.Username, action.Created)
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.broadcastEvent(message, eventMessageDeleted, message); err != nil {
+		log.Println(err)
+	}
+
+	log.Printf("%v: removed message %v by %v: %v\n", claims.Username, id, message.Author, body.Reason)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Endpoint for getting the latest moderation actions, optionally only those
+// against one user.
+func handleGetModerationActions(s *Server, w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	limit := s.config.DefaultPageSize
+	if value := params.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > s.config.MaxPageSize {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %v", s.config.MaxPageSize), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	actions, err := s.store.GetModerationActions(s.ctx, params.Get("username"), limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, actions)
+}
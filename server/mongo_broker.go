@@ -0,0 +1,135 @@
+// A Broker backed by a MongoDB change stream.
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// How long published events are kept. Subscribers only need them until
+	// the change stream has delivered them.
+	brokerEventRetention = time.Minute
+
+	// Delay before reopening an interrupted change stream.
+	brokerRetryDelay = time.Second
+)
+
+// Representation of a published event in the database.
+type mongoBrokerEvent struct {
+	Event   BrokerEvent `bson:"event"`
+	Created time.Time   `bson:"created"`
+}
+
+// Publishes events by inserting them into a collection, and receives them by
+// watching the collection's change stream. Requires MongoDB to run as a
+// replica set.
+type mongoBroker struct {
+	client *mongo.Client
+
+	// The events collection in the database.
+	events *mongo.Collection
+
+	// Stops watching the change stream.
+	cancel context.CancelFunc
+}
+
+// Connect to MongoDB and create a new broker.
+func newMongoBroker(ctx context.Context, config *Config) *mongoBroker {
+	client := connectToDatabase(ctx, config)
+	m := &mongoBroker{
+		client: client,
+		events: client.Database(config.MongoDatabase).Collection("events"),
+		cancel: func() {},
+	}
+
+	// Let MongoDB delete events once they have been delivered.
+	_, err := m.events.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"created": 1},
+		Options: options.Index().SetExpireAfterSeconds(int32(brokerEventRetention.Seconds())),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return m
+}
+
+func (m *mongoBroker) Publish(ctx context.Context, event BrokerEvent) error {
+	_, err := m.events.InsertOne(ctx, mongoBrokerEvent{Event: event, Created: time.Now()})
+	return err
+}
+
+func (m *mongoBroker) Subscribe(ctx context.Context) (<-chan BrokerEvent, error) {
+	ctx, m.cancel = context.WithCancel(ctx)
+
+	// Open the stream before returning so that no later event is missed.
+	stream, err := m.watch(ctx, nil)
+	if err != nil {
+		m.cancel()
+		return nil, err
+	}
+
+	events := make(chan BrokerEvent)
+	go m.receive(ctx, stream, events)
+	return events, nil
+}
+
+// Open a change stream of inserted events, resuming after the given token if
+// it is not nil.
+func (m *mongoBroker) watch(ctx context.Context, resumeAfter bson.Raw) (*mongo.ChangeStream, error) {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{"operationType": "insert"}}}}
+	opts := options.ChangeStream()
+	if resumeAfter != nil {
+		opts.SetResumeAfter(resumeAfter)
+	}
+	return m.events.Watch(ctx, pipeline, opts)
+}
+
+// Send every event from the change stream to events until ctx is cancelled,
+// resuming the stream where it left off if it is interrupted so that no event
+// is missed or repeated.
+func (m *mongoBroker) receive(ctx context.Context, stream *mongo.ChangeStream, events chan<- BrokerEvent) {
+	for {
+		for stream.Next(ctx) {
+			var change struct {
+				FullDocument mongoBrokerEvent `bson:"fullDocument"`
+			}
+			if err := stream.Decode(&change); err != nil {
+				log.Println(err)
+				continue
+			}
+			select {
+			case events <- change.FullDocument.Event:
+			case <-ctx.Done():
+			}
+		}
+		resumeAfter, err := stream.ResumeToken(), stream.Err()
+		stream.Close(context.Background())
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Event stream interrupted: %v\n", err)
+
+		for {
+			time.Sleep(brokerRetryDelay)
+			if stream, err = m.watch(ctx, resumeAfter); err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Error resuming event stream: %v\n", err)
+		}
+	}
+}
+
+func (m *mongoBroker) Close() error {
+	m.cancel()
+	return m.client.Disconnect(context.Background())
+}
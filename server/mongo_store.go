@@ -0,0 +1,946 @@
+// A Store backed by MongoDB.
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Codes of the errors MongoDB returns when creating an index that exists with
+// different options, or under the same name with different keys.
+const (
+	indexOptionsConflict  = 85
+	indexKeySpecsConflict = 86
+)
+
+// Return whether err is from creating an index that conflicts with an
+// existing one.
+func isIndexConflict(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && (cmdErr.Code == indexOptionsConflict || cmdErr.Code == indexKeySpecsConflict)
+}
+
+type mongoStore struct {
+	// The connection to the MongoDB database.
+	client *mongo.Client
+
+	// The users collection in the database.
+	users *mongo.Collection
+
+	// The messages collection in the database.
+	messages *mongo.Collection
+
+	// The channels collection in the database.
+	channels *mongo.Collection
+
+	// The conversations collection in the database.
+	conversations *mongo.Collection
+
+	// The read markers collection in the database.
+	readMarkers *mongo.Collection
+
+	// The refresh tokens collection in the database.
+	refreshTokens *mongo.Collection
+
+	// The revoked tokens collection in the database.
+	revokedTokens *mongo.Collection
+
+	// The moderation actions collection in the database.
+	moderationActions *mongo.Collection
+
+	// The collection of the latest sequence number of each stream in the
+	// database.
+	sequences *mongo.Collection
+
+	// The stream events collection in the database.
+	streamEvents *mongo.Collection
+}
+
+// Connect to MongoDB and create a new store.
+func newMongoStore(ctx context.Context, config *Config) *mongoStore {
+	client := connectToDatabase(ctx, config)
+	db := client.Database(config.MongoDatabase)
+
+	m := &mongoStore{
+		client:        client,
+		users:         db.Collection("users"),
+		messages:      db.Collection("messages"),
+		channels:      db.Collection("channels"),
+		conversations: db.Collection("conversations"),
+		readMarkers:   db.Collection("readMarkers"),
+		refreshTokens: db.Collection("refreshTokens"),
+		revokedTokens: db.Collection("revokedTokens"),
+
+		moderationActions: db.Collection("moderationActions"),
+		sequences:         db.Collection("sequences"),
+		streamEvents:      db.Collection("streamEvents"),
+	}
+
+	// There is at most one conversation per set of participants.
+	_, err := m.conversations.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"key": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// There is at most one read marker per user and channel or conversation.
+	_, err = m.readMarkers.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "username", Value: 1}, {Key: "channel", Value: 1}, {Key: "conversation", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Let MongoDB delete expired refresh tokens, and find token families
+	// quickly.
+	_, err = m.refreshTokens.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"expires": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		{Keys: bson.M{"family": 1}},
+		{Keys: bson.M{"username": 1}},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Let MongoDB forget revocations once the revoked tokens have expired.
+	_, err = m.revokedTokens.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"expires": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Find the latest moderation actions against a user quickly.
+	_, err = m.moderationActions.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "target", Value: 1}, {Key: "created", Value: -1}},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// There is one event per stream and sequence number, and events are
+	// deleted once they are too old to be replayed. The expiry of an existing
+	// index is updated if replay-retention changed.
+	_, err = m.streamEvents.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "stream", Value: 1}, {Key: "seq", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	retention := int32(config.ReplayRetention.Seconds())
+	_, err = m.streamEvents.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"created": 1},
+		Options: options.Index().SetExpireAfterSeconds(retention),
+	})
+	if isIndexConflict(err) {
+		err = db.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: m.streamEvents.Name()},
+			{Key: "index", Value: bson.D{
+				{Key: "keyPattern", Value: bson.M{"created": 1}},
+				{Key: "expireAfterSeconds", Value: retention},
+			}},
+		}).Err()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Support paging through the history of channels, conversations, and
+	// threads.
+	_, err = m.messages.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "channel", Value: 1}, {Key: "created", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "conversation", Value: 1}, {Key: "created", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "parentID", Value: 1}, {Key: "created", Value: -1}, {Key: "_id", Value: -1}}},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Support searching message content. The index neither stems words nor
+	// ignores stop words, so that it finds every message that SearchMessages
+	// matches exactly. A text index created with another language is
+	// replaced, as a collection can only have one.
+	textIndex := mongo.IndexModel{
+		Keys:    bson.M{"content": "text"},
+		Options: options.Index().SetName("content_text").SetDefaultLanguage("none"),
+	}
+	_, err = m.messages.Indexes().CreateOne(ctx, textIndex)
+	if isIndexConflict(err) {
+		if _, err = m.messages.Indexes().DropOne(ctx, "content_text"); err == nil {
+			_, err = m.messages.Indexes().CreateOne(ctx, textIndex)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return m
+}
+
+// Creates a connection to the database and returns the corresponding Client.
+func connectToDatabase(ctx context.Context, config *Config) *mongo.Client {
+	credentials := options.Credential{
+		Username: config.MongoUsername,
+		Password: config.MongoPassword,
+	}
+	options := options.Client().ApplyURI(config.MongoURI).SetAuth(credentials)
+	client, err := mongo.Connect(ctx, options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("MongoDB client successfully connected.")
+
+	return client
+}
+
+func (m *mongoStore) CreateUser(ctx context.Context, user User) error {
+	_, err := m.users.InsertOne(ctx, user)
+	return err
+}
+
+func (m *mongoStore) GetUser(ctx context.Context, username string) (User, error) {
+	var user User
+	if err := m.users.FindOne(ctx, bson.M{"username": username}).Decode(&user); err != nil {
+		return User{}, translateMongoError(err)
+	}
+
+	return user, nil
+}
+
+func (m *mongoStore) UpdateUserVotes(ctx context.Context, user User) error {
+	objectID, err := primitive.ObjectIDFromHex(user.ID)
+	if err != nil {
+		return errNotFound
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"upvoted":   user.Upvoted,
+			"downvoted": user.Downvoted,
+		},
+	}
+	return translateMongoError(m.users.FindOneAndUpdate(ctx, bson.M{"_id": objectID}, update).Err())
+}
+
+func (m *mongoStore) AddUserRole(ctx context.Context, username string, role Role) (bool, error) {
+	return m.updateUserRoles(ctx, username, bson.M{"$addToSet": bson.M{"roles": role}})
+}
+
+func (m *mongoStore) RemoveUserRole(ctx context.Context, username string, role Role) (bool, error) {
+	return m.updateUserRoles(ctx, username, bson.M{"$pull": bson.M{"roles": role}})
+}
+
+// Apply an update to the user's roles, returning whether it changed them, or
+// errNotFound.
+func (m *mongoStore) updateUserRoles(ctx context.Context, username string, update bson.M) (bool, error) {
+	result, err := m.users.UpdateOne(ctx, bson.M{"username": username}, update)
+	if err != nil {
+		return false, err
+	}
+	if result.MatchedCount == 0 {
+		return false, errNotFound
+	}
+
+	return result.ModifiedCount > 0, nil
+}
+
+func (m *mongoStore) SetUserBanned(ctx context.Context, username string, banned bool) error {
+	update := bson.M{"$unset": bson.M{"banned": ""}}
+	if banned {
+		update = bson.M{"$set": bson.M{"banned": true}}
+	}
+	return m.updateUser(ctx, username, update)
+}
+
+func (m *mongoStore) SetUserMutedUntil(ctx context.Context, username string, until *time.Time) error {
+	update := bson.M{"$unset": bson.M{"mutedUntil": ""}}
+	if until != nil {
+		update = bson.M{"$set": bson.M{"mutedUntil": *until}}
+	}
+	return m.updateUser(ctx, username, update)
+}
+
+// Apply an update to the user, or return errNotFound.
+func (m *mongoStore) updateUser(ctx context.Context, username string, update bson.M) error {
+	result, err := m.users.UpdateOne(ctx, bson.M{"username": username}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errNotFound
+	}
+
+	return nil
+}
+
+func (m *mongoStore) CreateModerationAction(ctx context.Context, action ModerationAction) error {
+	action.ID = primitive.NewObjectID().Hex()
+	_, err := m.moderationActions.InsertOne(ctx, action)
+	return err
+}
+
+func (m *mongoStore) GetModerationActions(ctx context.Context, username string, limit int) ([]ModerationAction, error) {
+	filter := bson.M{}
+	if username != "" {
+		filter["target"] = username
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(int64(limit))
+	cursor, err := m.moderationActions.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	actions := []ModerationAction{}
+	if err := cursor.All(ctx, &actions); err != nil {
+		return nil, err
+	}
+
+	return actions, nil
+}
+
+func (m *mongoStore) RemoveVotes(ctx context.Context, ids []string) error {
+	unset := bson.M{}
+	for _, id := range ids {
+		unset["upvoted."+id] = ""
+		unset["downvoted."+id] = ""
+	}
+	_, err := m.users.UpdateMany(ctx, bson.M{}, bson.M{"$unset": unset})
+	return err
+}
+
+func (m *mongoStore) CreateRefreshToken(ctx context.Context, token RefreshToken) error {
+	_, err := m.refreshTokens.InsertOne(ctx, token)
+	return err
+}
+
+func (m *mongoStore) UseRefreshToken(ctx context.Context, id string, used time.Time) (RefreshToken, error) {
+	// $min leaves the time of the first use in place if the token was used
+	// already.
+	update := bson.M{"$min": bson.M{"used": used}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+
+	var token RefreshToken
+	if err := m.refreshTokens.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, opts).Decode(&token); err != nil {
+		return RefreshToken{}, translateMongoError(err)
+	}
+
+	return token, nil
+}
+
+func (m *mongoStore) RevokeRefreshTokenFamily(ctx context.Context, family string) error {
+	_, err := m.refreshTokens.DeleteMany(ctx, bson.M{"family": family})
+	return err
+}
+
+func (m *mongoStore) GetUserSessions(ctx context.Context, username string) ([]string, error) {
+	families, err := m.refreshTokens.Distinct(ctx, "family", bson.M{"username": username})
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]string, 0, len(families))
+	for _, family := range families {
+		sessions = append(sessions, family.(string))
+	}
+
+	return sessions, nil
+}
+
+func (m *mongoStore) RevokeTokens(ctx context.Context, ids []string, expires time.Time) error {
+	for _, id := range ids {
+		update := bson.M{"$max": bson.M{"expires": expires}}
+		_, err := m.revokedTokens.UpdateOne(ctx, bson.M{"_id": id}, update, options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *mongoStore) AreTokensRevoked(ctx context.Context, ids []string) (bool, error) {
+	count, err := m.revokedTokens.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (m *mongoStore) NextSequence(ctx context.Context, stream string) (int64, error) {
+	var sequence struct {
+		Seq int64 `bson:"seq"`
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := m.sequences.FindOneAndUpdate(ctx, bson.M{"_id": stream}, bson.M{"$inc": bson.M{"seq": 1}}, opts).Decode(&sequence)
+	return sequence.Seq, err
+}
+
+func (m *mongoStore) GetSequence(ctx context.Context, stream string) (int64, error) {
+	var sequence struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := m.sequences.FindOne(ctx, bson.M{"_id": stream}).Decode(&sequence)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	return sequence.Seq, err
+}
+
+func (m *mongoStore) SaveStreamEvent(ctx context.Context, event StreamEvent) error {
+	_, err := m.streamEvents.InsertOne(ctx, event)
+	return err
+}
+
+func (m *mongoStore) GetStreamEvents(ctx context.Context, stream string, after int64, limit int) ([]StreamEvent, error) {
+	filter := bson.M{"stream": stream, "seq": bson.M{"$gt": after}}
+	opts := options.Find().SetSort(bson.M{"seq": 1}).SetLimit(int64(limit))
+	cursor, err := m.streamEvents.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []StreamEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (m *mongoStore) GetMessages(ctx context.Context, query MessageQuery) ([]Message, bool, error) {
+	var filter bson.M
+	if query.ParentID != "" {
+		filter = bson.M{"parentID": query.ParentID}
+	} else {
+		filter = targetFilter(query.Target)
+		filter["parentID"] = bson.M{"$exists": false}
+	}
+
+	return m.findPage(ctx, filter, query.Before, query.After, query.Limit)
+}
+
+func (m *mongoStore) SearchMessages(ctx context.Context, query SearchQuery) ([]Message, bool, error) {
+	filter := bson.M{"deleted": bson.M{"$exists": false}}
+
+	// Narrow the candidates down with the text index, which matches messages
+	// containing any term, or every phrase if there are phrases. Phrases
+	// without tokens cannot be searched for in the index.
+	search := append([]string{}, query.Terms...)
+	for _, phrase := range query.Phrases {
+		if len(tokenize(phrase.Text)) > 0 {
+			search = append(search, `"`+phrase.Text+`"`)
+		}
+	}
+	if len(search) > 0 {
+		filter["$text"] = bson.M{"$search": strings.Join(search, " ")}
+	}
+
+	// Then match every term and phrase as whole words, ignoring case, like
+	// the memory store.
+	conditions := bson.A{}
+	for _, term := range query.Terms {
+		conditions = append(conditions, bson.M{"content": primitive.Regex{Pattern: wordsPattern(term), Options: "i"}})
+	}
+	for _, phrase := range query.Phrases {
+		conditions = append(conditions, bson.M{"content": primitive.Regex{Pattern: wordsPattern(phrase.Text), Options: "i"}})
+	}
+	if len(conditions) > 0 {
+		filter["$and"] = conditions
+	}
+
+	targets := bson.A{}
+	for _, target := range query.Targets {
+		targets = append(targets, targetFilter(target))
+	}
+	filter["$or"] = targets
+
+	if query.Author != "" {
+		filter["author"] = query.Author
+	}
+	created := bson.M{}
+	if query.Since != nil {
+		created["$gte"] = *query.Since
+	}
+	if query.Until != nil {
+		created["$lt"] = *query.Until
+	}
+	if len(created) > 0 {
+		filter["created"] = created
+	}
+
+	return m.findPage(ctx, filter, query.Before, query.After, query.Limit)
+}
+
+// Find a page of the messages matching filter in chronological order, and
+// whether more messages lie beyond the page.
+func (m *mongoStore) findPage(ctx context.Context, filter bson.M, before *messageCursor, after *messageCursor, limit int) ([]Message, bool, error) {
+	// Walk history backwards unless paging forwards from a cursor.
+	direction := -1
+	if before != nil {
+		filter = bson.M{"$and": bson.A{filter, cursorCondition(before, "$lt")}}
+	}
+	if after != nil {
+		direction = 1
+		filter = bson.M{"$and": bson.A{filter, cursorCondition(after, "$gt")}}
+	}
+
+	// Fetch one extra message to find out whether there are more.
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created", Value: direction}, {Key: "_id", Value: direction}}).
+		SetLimit(int64(limit + 1)).
+		SetProjection(bson.M{"revisions": 0})
+	cursor, err := m.messages.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, false, err
+	}
+
+	messages := []Message{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, false, err
+	}
+	more := len(messages) > limit
+	if more {
+		messages = messages[:limit]
+	}
+	if direction < 0 {
+		reverseMessages(messages)
+	}
+
+	return messages, more, nil
+}
+
+// Filter matching messages posted to a channel or conversation.
+func targetFilter(target Target) bson.M {
+	if target.Conversation != "" {
+		return bson.M{"conversation": target.Conversation}
+	}
+	if target.Channel == defaultChannel {
+		// Messages from before channels existed have no channel field.
+		return bson.M{"channel": bson.M{"$in": bson.A{defaultChannel, nil}}}
+	}
+	return bson.M{"channel": target.Channel}
+}
+
+// Filter matching messages strictly before ($lt) or after ($gt) the cursor in
+// history.
+func cursorCondition(cursor *messageCursor, op string) bson.M {
+	// Cursor IDs are validated when they are decoded.
+	objectID, _ := primitive.ObjectIDFromHex(cursor.ID)
+	return bson.M{"$or": bson.A{
+		bson.M{"created": bson.M{op: cursor.Created}},
+		bson.M{"created": cursor.Created, "_id": bson.M{op: objectID}},
+	}}
+}
+
+func (m *mongoStore) GetMessage(ctx context.Context, id string) (Message, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return Message{}, errNotFound
+	}
+
+	var message Message
+	if err := m.messages.FindOne(ctx, bson.M{"_id": objectID}).Decode(&message); err != nil {
+		return Message{}, translateMongoError(err)
+	}
+
+	return message, nil
+}
+
+func (m *mongoStore) CreateMessage(ctx context.Context, message Message) (string, error) {
+	insertResult, err := m.messages.InsertOne(ctx, message)
+	if err != nil {
+		return "", err
+	}
+
+	return insertResult.InsertedID.(primitive.ObjectID).Hex(), nil
+}
+
+func (m *mongoStore) EditMessage(ctx context.Context, id string, content string, edited time.Time) (Message, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return Message{}, errNotFound
+	}
+
+	// Push the current content onto the revisions in the same update that
+	// replaces it, so that concurrent edits cannot lose a revision.
+	update := bson.A{bson.M{"$set": bson.M{
+		"revisions": bson.M{"$concatArrays": bson.A{
+			bson.M{"$ifNull": bson.A{"$revisions", bson.A{}}},
+			bson.A{bson.M{
+				"content": "$content",
+				"created": bson.M{"$ifNull": bson.A{"$edited", "$created"}},
+			}},
+		}},
+		"content": content,
+		"edited":  edited,
+	}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	// Tombstones cannot be edited, even if deleted since the caller fetched
+	// the message.
+	filter := bson.M{"_id": objectID, "deleted": bson.M{"$exists": false}}
+
+	var message Message
+	if err := m.messages.FindOneAndUpdate(ctx, filter, update, opts).Decode(&message); err != nil {
+		return Message{}, translateMongoError(err)
+	}
+
+	return message, nil
+}
+
+func (m *mongoStore) DeleteMessage(ctx context.Context, id string, deletedBy string, deleted time.Time) (Message, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return Message{}, errNotFound
+	}
+	update := bson.M{
+		"$set":   bson.M{"content": "", "deleted": deleted, "deletedBy": deletedBy},
+		"$unset": bson.M{"revisions": "", "reactions": ""},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var message Message
+	if err := m.messages.FindOneAndUpdate(ctx, bson.M{"_id": objectID}, update, opts).Decode(&message); err != nil {
+		return Message{}, translateMongoError(err)
+	}
+
+	return message, nil
+}
+
+func (m *mongoStore) PurgeMessages(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	filter := bson.M{"deleted": bson.M{"$lt": deletedBefore}}
+	cursor, err := m.messages.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var tombstones []Message
+	if err := cursor.All(ctx, &tombstones); err != nil {
+		return nil, err
+	}
+	if len(tombstones) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, 0, len(tombstones))
+	objectIDs := bson.A{}
+	for _, tombstone := range tombstones {
+		ids = append(ids, tombstone.ID)
+		objectID, _ := primitive.ObjectIDFromHex(tombstone.ID)
+		objectIDs = append(objectIDs, objectID)
+	}
+	if _, err := m.messages.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": objectIDs}}); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (m *mongoStore) AddReply(ctx context.Context, id string, replied time.Time) (Message, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return Message{}, errNotFound
+	}
+	update := bson.M{
+		"$inc": bson.M{"replyCount": 1},
+		"$max": bson.M{"lastReply": replied},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"revisions": 0})
+
+	var message Message
+	if err := m.messages.FindOneAndUpdate(ctx, bson.M{"_id": objectID}, update, opts).Decode(&message); err != nil {
+		return Message{}, translateMongoError(err)
+	}
+
+	return message, nil
+}
+
+func (m *mongoStore) AddReaction(ctx context.Context, id string, emoji string, username string) (Message, bool, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return Message{}, false, errNotFound
+	}
+
+	// Only match the message if the user has not reacted yet, so that we can
+	// tell whether the reaction changed.
+	field := "reactions." + emoji
+	filter := bson.M{"_id": objectID, field: bson.M{"$ne": username}}
+	update := bson.M{"$push": bson.M{field: username}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"revisions": 0})
+
+	var message Message
+	err = m.messages.FindOneAndUpdate(ctx, filter, update, opts).Decode(&message)
+	if err == mongo.ErrNoDocuments {
+		message, err = m.GetMessage(ctx, id)
+		return message, false, err
+	}
+	if err != nil {
+		return Message{}, false, err
+	}
+
+	return message, true, nil
+}
+
+func (m *mongoStore) RemoveReaction(ctx context.Context, id string, emoji string, username string) (Message, bool, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return Message{}, false, errNotFound
+	}
+
+	// Only match the message if the user has reacted, and drop the emoji
+	// entirely once nobody is left reacting with it.
+	field := "reactions." + emoji
+	filter := bson.M{"_id": objectID, field: username}
+	update := bson.A{bson.M{"$set": bson.M{
+		"reactions": bson.M{"$arrayToObject": bson.M{"$filter": bson.M{
+			"input": bson.M{"$map": bson.M{
+				"input": bson.M{"$objectToArray": "$reactions"},
+				"in": bson.M{"$cond": bson.A{
+					bson.M{"$eq": bson.A{"$$this.k", emoji}},
+					bson.M{"k": "$$this.k", "v": bson.M{"$filter": bson.M{
+						"input": "$$this.v",
+						"as":    "user",
+						"cond":  bson.M{"$ne": bson.A{"$$user", bson.M{"$literal": username}}},
+					}}},
+					"$$this",
+				}},
+			}},
+			"cond": bson.M{"$gt": bson.A{bson.M{"$size": "$$this.v"}, 0}},
+		}}},
+	}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"revisions": 0})
+
+	var message Message
+	err = m.messages.FindOneAndUpdate(ctx, filter, update, opts).Decode(&message)
+	if err == mongo.ErrNoDocuments {
+		message, err = m.GetMessage(ctx, id)
+		return message, false, err
+	}
+	if err != nil {
+		return Message{}, false, err
+	}
+
+	return message, true, nil
+}
+
+func (m *mongoStore) UpdateMessageVotes(ctx context.Context, id string, n int) error {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return errNotFound
+	}
+	update := bson.M{"$inc": bson.M{"votes": n}}
+	return translateMongoError(m.messages.FindOneAndUpdate(ctx, bson.M{"_id": objectID}, update).Err())
+}
+
+func (m *mongoStore) SetReadMarker(ctx context.Context, marker ReadMarker) (bool, error) {
+	// Only match an existing marker that is behind the new one. If it is not
+	// behind, the upsert conflicts with it instead.
+	filter := bson.M{
+		"username":     marker.Username,
+		"channel":      marker.Channel,
+		"conversation": marker.Conversation,
+		"$or": bson.A{
+			bson.M{"messageCreated": bson.M{"$lt": marker.MessageCreated}},
+			bson.M{"messageCreated": marker.MessageCreated, "messageID": bson.M{"$lt": marker.MessageID}},
+		},
+	}
+	update := bson.M{"$set": bson.M{
+		"messageID":      marker.MessageID,
+		"messageCreated": marker.MessageCreated,
+		"read":           marker.Read,
+	}}
+
+	result, err := m.readMarkers.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount > 0 || result.UpsertedCount > 0, nil
+}
+
+func (m *mongoStore) GetReadMarker(ctx context.Context, username string, target Target) (ReadMarker, error) {
+	filter := bson.M{"username": username, "channel": target.Channel, "conversation": target.Conversation}
+
+	var marker ReadMarker
+	if err := m.readMarkers.FindOne(ctx, filter).Decode(&marker); err != nil {
+		return ReadMarker{}, translateMongoError(err)
+	}
+
+	return marker, nil
+}
+
+func (m *mongoStore) CountUnread(ctx context.Context, username string, target Target, after *messageCursor) (int, error) {
+	filter := targetFilter(target)
+	filter["parentID"] = bson.M{"$exists": false}
+	filter["deleted"] = bson.M{"$exists": false}
+	filter["author"] = bson.M{"$ne": username}
+	if after != nil {
+		filter = bson.M{"$and": bson.A{filter, cursorCondition(after, "$gt")}}
+	}
+
+	count, err := m.messages.CountDocuments(ctx, filter)
+	return int(count), err
+}
+
+func (m *mongoStore) CreateChannel(ctx context.Context, channel Channel) error {
+	if channel.Members == nil {
+		channel.Members = []string{}
+	}
+	if _, err := m.channels.InsertOne(ctx, channel); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return errAlreadyExists
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (m *mongoStore) GetChannel(ctx context.Context, name string) (Channel, error) {
+	var channel Channel
+	if err := m.channels.FindOne(ctx, bson.M{"_id": name}).Decode(&channel); err != nil {
+		return Channel{}, translateMongoError(err)
+	}
+
+	return channel, nil
+}
+
+func (m *mongoStore) GetAllChannels(ctx context.Context) ([]Channel, error) {
+	cursor, err := m.channels.Find(ctx, bson.D{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	channels := []Channel{}
+	if err := cursor.All(ctx, &channels); err != nil {
+		return nil, err
+	}
+
+	return channels, nil
+}
+
+func (m *mongoStore) AddChannelMember(ctx context.Context, name string, username string) error {
+	update := bson.M{"$addToSet": bson.M{"members": username}}
+	return translateMongoError(m.channels.FindOneAndUpdate(ctx, bson.M{"_id": name}, update).Err())
+}
+
+func (m *mongoStore) RemoveChannelMember(ctx context.Context, name string, username string) error {
+	update := bson.M{"$pull": bson.M{"members": username}}
+	return translateMongoError(m.channels.FindOneAndUpdate(ctx, bson.M{"_id": name}, update).Err())
+}
+
+func (m *mongoStore) GetUserChannels(ctx context.Context, username string) ([]string, error) {
+	cursor, err := m.channels.Find(ctx, bson.M{"members": username})
+	if err != nil {
+		return nil, err
+	}
+
+	var channels []Channel
+	if err := cursor.All(ctx, &channels); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		names = append(names, channel.Name)
+	}
+
+	return names, nil
+}
+
+func (m *mongoStore) GetOrCreateConversation(ctx context.Context, conversation Conversation) (Conversation, error) {
+	filter := bson.M{"key": conversation.Key}
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"participants": conversation.Participants,
+			"created":      conversation.Created,
+		},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var result Conversation
+	err := m.conversations.FindOneAndUpdate(ctx, filter, update, opts).Decode(&result)
+	if mongo.IsDuplicateKeyError(err) {
+		// A concurrent upsert inserted the conversation first, so it exists now.
+		err = m.conversations.FindOne(ctx, filter).Decode(&result)
+	}
+	if err != nil {
+		return Conversation{}, err
+	}
+
+	return result, nil
+}
+
+func (m *mongoStore) GetConversation(ctx context.Context, id string) (Conversation, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return Conversation{}, errNotFound
+	}
+
+	var conversation Conversation
+	if err := m.conversations.FindOne(ctx, bson.M{"_id": objectID}).Decode(&conversation); err != nil {
+		return Conversation{}, translateMongoError(err)
+	}
+
+	return conversation, nil
+}
+
+func (m *mongoStore) GetUserConversations(ctx context.Context, username string) ([]Conversation, error) {
+	cursor, err := m.conversations.Find(ctx, bson.M{"participants": username})
+	if err != nil {
+		return nil, err
+	}
+
+	conversations := []Conversation{}
+	if err := cursor.All(ctx, &conversations); err != nil {
+		return nil, err
+	}
+
+	return conversations, nil
+}
+
+func (m *mongoStore) ExecuteAsTransaction(ctx context.Context, f func(ctx context.Context) error) error {
+	// Join the transaction in progress, as sessions cannot nest them.
+	if mongo.SessionFromContext(ctx) != nil {
+		return f(ctx)
+	}
+
+	session, err := m.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	// Operations must use the session context to take part in the transaction.
+	// See: https://www.mongodb.com/docs/drivers/go/current/fundamentals/transactions/.
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, f(sc)
+	})
+
+	return err
+}
+
+func (m *mongoStore) Disconnect(ctx context.Context) error {
+	return m.client.Disconnect(ctx)
+}
+
+// Map driver errors onto the errors defined by the Store interface.
+func translateMongoError(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return errNotFound
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+// Cursor-based pagination of message history.
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Position of a message in history, which is ordered by creation time and then
+// by ID to break ties.
+type messageCursor struct {
+	Created time.Time
+	ID      string
+}
+
+// Return the cursor pointing at the given message.
+func cursorFor(message Message) *messageCursor {
+	return &messageCursor{Created: message.Created, ID: message.ID}
+}
+
+// Return -1, 0, or 1 if the message comes before, at, or after the cursor in
+// history.
+func (c *messageCursor) compare(message Message) int {
+	switch {
+	case message.Created.Before(c.Created):
+		return -1
+	case message.Created.After(c.Created):
+		return 1
+	case message.ID < c.ID:
+		return -1
+	case message.ID > c.ID:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Serialize the cursor into an opaque token.
+func (c *messageCursor) encode() string {
+	raw := strconv.FormatInt(c.Created.UnixNano(), 10) + ":" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// Returned when decoding a malformed cursor token.
+var errInvalidCursor = errors.New("invalid cursor")
+
+// Parse a token produced by encode.
+func decodeCursor(token string) (*messageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok || !primitive.IsValidObjectID(id) {
+		return nil, errInvalidCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	return &messageCursor{Created: time.Unix(0, n), ID: id}, nil
+}
+
+// Which messages to return from a store.
+type MessageQuery struct {
+	// The channel or conversation the messages were posted to. Ignored if
+	// ParentID is set.
+	Target
+
+	// If set, return the replies to this message. Otherwise, only return
+	// messages that are not replies.
+	ParentID string
+
+	// If set, only return messages strictly before this cursor.
+	Before *messageCursor
+
+	// If set, only return messages strictly after this cursor. Mutually
+	// exclusive with Before.
+	After *messageCursor
+
+	// Maximum number of messages to return.
+	Limit int
+}
+
+// Messages that match a query, in chronological order. When neither cursor is
+// set or Before is set, these are the latest matching messages; when After is
+// set, these are the earliest.
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+
+	// Token to pass as the same cursor parameter to continue paging in the
+	// same direction. Empty if there are no more messages.
+	NextCursor string `json:"nextCursor,omitempty"`
+
+	// Number of unread messages in the channel or conversation. Not set for
+	// pages of replies.
+	Unread *int `json:"unread,omitempty"`
+
+	// ID of the latest message read in the channel or conversation, if any.
+	LastRead string `json:"lastRead,omitempty"`
+}
+
+// Read the before, after, and limit query parameters of a request into query.
+func (s *Server) parsePageParameters(r *http.Request, query *MessageQuery) error {
+	params := r.URL.Query()
+
+	var err error
+	if token := params.Get("before"); token != "" {
+		if query.Before, err = decodeCursor(token); err != nil {
+			return newAPIError(http.StatusBadRequest, "Invalid before cursor.")
+		}
+	}
+	if token := params.Get("after"); token != "" {
+		if query.Before != nil {
+			return newAPIError(http.StatusBadRequest, "before and after cannot both be set")
+		}
+		if query.After, err = decodeCursor(token); err != nil {
+			return newAPIError(http.StatusBadRequest, "Invalid after cursor.")
+		}
+	}
+
+	query.Limit = s.config.DefaultPageSize
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > s.config.MaxPageSize {
+			return newAPIError(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %v", s.config.MaxPageSize))
+		}
+		query.Limit = n
+	}
+
+	return nil
+}
+
+// Fetch the page of messages matching query.
+func (s *Server) getMessagePage(query MessageQuery) (MessagePage, error) {
+	messages, more, err := s.store.GetMessages(s.ctx, query)
+	if err != nil {
+		return MessagePage{}, err
+	}
+
+	return MessagePage{Messages: messages, NextCursor: nextCursor(messages, more, query.After != nil)}, nil
+}
+
+// Return the token to continue paging past a page of messages in chronological
+// order, or an empty string if there are no more messages.
+func nextCursor(messages []Message, more bool, forwards bool) string {
+	if !more || len(messages) == 0 {
+		return ""
+	}
+	if forwards {
+		return cursorFor(messages[len(messages)-1]).encode()
+	}
+	return cursorFor(messages[0]).encode()
+}
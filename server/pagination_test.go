@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCursorEncoding(t *testing.T) {
+	cursor := &messageCursor{Created: time.Unix(1700000000, 123456789), ID: primitive.NewObjectID().Hex()}
+	decoded, err := decodeCursor(cursor.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Created.Equal(cursor.Created) || decoded.ID != cursor.ID {
+		t.Errorf("got %+v, want %+v", decoded, cursor)
+	}
+
+	encode := func(raw string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+	for _, token := range []string{
+		"",
+		"not base64!",
+		encode("1700000000"),
+		encode("1700000000:not-an-id"),
+		encode("yesterday:" + cursor.ID),
+		cursor.encode() + "=",
+	} {
+		if _, err := decodeCursor(token); err != errInvalidCursor {
+			t.Errorf("decoding %q: got %v, want %v", token, err, errInvalidCursor)
+		}
+	}
+}
+
+// Messages created at the same time are ordered by ID, so paging through
+// them in either direction returns each exactly once.
+func TestPaginateTies(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		created := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+		ids := map[string]bool{}
+		for i := 0; i < 5; i++ {
+			id, err := store.CreateMessage(ctx, Message{Author: "alice", Channel: defaultChannel, Content: "tie", Created: created})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids[id] = true
+		}
+
+		for _, forwards := range []bool{false, true} {
+			// Pages are the latest messages unless After is set.
+			query := MessageQuery{Target: Target{Channel: defaultChannel}, Limit: 2}
+			if forwards {
+				query.After = &messageCursor{}
+			}
+			seen := map[string]bool{}
+			for {
+				messages, more, err := store.GetMessages(ctx, query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i, message := range messages {
+					if seen[message.ID] {
+						t.Fatalf("message %v returned twice", message.ID)
+					}
+					seen[message.ID] = true
+					if i > 0 && cursorFor(messages[i-1]).compare(message) != 1 {
+						t.Errorf("page is not in chronological order: %v", messages)
+					}
+				}
+
+				token := nextCursor(messages, more, forwards)
+				if token == "" {
+					break
+				}
+				cursor, err := decodeCursor(token)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if forwards {
+					query.After = cursor
+				} else {
+					query.Before = cursor
+				}
+			}
+			if len(seen) != len(ids) {
+				t.Errorf("paging forwards %v returned %v of %v messages", forwards, len(seen), len(ids))
+			}
+		}
+	})
+}
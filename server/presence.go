@@ -0,0 +1,229 @@
+// Tracking of which users are online, derived from their websocket connections
+// to every replica.
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	// Delay between checks for users that have become idle, which is also how
+	// often each replica publishes the presence of its users.
+	idleCheckInterval = 30 * time.Second
+
+	// Time after which the presence published by a replica that stopped
+	// publishing it is forgotten.
+	presenceExpiry = 3 * idleCheckInterval
+)
+
+// Presence states of a user.
+const (
+	// The user has a connection and has been active recently.
+	presenceOnline = "online"
+
+	// The user has a connection but has not been active recently.
+	presenceIdle = "idle"
+
+	// The user has no connections.
+	presenceOffline = "offline"
+)
+
+// Order of the presence states, from least to most present.
+var presenceRank = map[string]int{
+	presenceOffline: 0,
+	presenceIdle:    1,
+	presenceOnline:  2,
+}
+
+// Presence of a user over the wire. Also the payload of a presence_changed
+// event.
+type Presence struct {
+	Username string `json:"username"`
+	State    string `json:"state"`
+
+	// When the user was last active. Omitted while the user is online.
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+// The presence of a user on one replica, computed from its clients.
+type ReplicaPresence struct {
+	Username string `bson:"username"`
+	State    string `bson:"state"`
+
+	// When the user was last active on the replica, if ever.
+	LastActive time.Time `bson:"lastActive"`
+}
+
+// The presence of users on a replica, as it last published it.
+type replicaPresences struct {
+	users map[string]ReplicaPresence
+
+	// When the replica last published the presence of any user.
+	updated time.Time
+}
+
+// Compute the presence of a user on this replica from its registered clients.
+// Must be called from the hub goroutine.
+func (h *Hub) localPresence(username string) ReplicaPresence {
+	presence := ReplicaPresence{Username: username, State: presenceOffline, LastActive: h.lastSeen[username]}
+
+	connected := false
+	for client := range h.clients {
+		if client.username != username {
+			continue
+		}
+		connected = true
+		if client.lastActive.After(presence.LastActive) {
+			presence.LastActive = client.lastActive
+		}
+	}
+
+	switch {
+	case connected && time.Since(presence.LastActive) < h.idleTimeout:
+		presence.State = presenceOnline
+	case connected:
+		presence.State = presenceIdle
+	}
+
+	return presence
+}
+
+// Recompute the presence of a user on this replica, and publish it to every
+// replica if it changed. Must be called from the hub goroutine.
+func (h *Hub) updatePresence(username string) {
+	presence := h.localPresence(username)
+	if h.published[username].State == presence.State {
+		return
+	}
+	h.published[username] = presence
+
+	if err := h.publish(BrokerEvent{Presence: &BrokerPresence{Replica: h.replica, Users: []ReplicaPresence{presence}}}); err != nil {
+		log.Println(err)
+	}
+}
+
+// Recompute and publish the presence of every user seen on this replica, so
+// that users become idle, replicas that started later learn of them, and
+// other replicas do not forget them. Must be called from the hub goroutine.
+func (h *Hub) publishAllPresence() {
+	if len(h.published) == 0 {
+		return
+	}
+
+	presences := make([]ReplicaPresence, 0, len(h.published))
+	for username := range h.published {
+		presence := h.localPresence(username)
+		h.published[username] = presence
+		presences = append(presences, presence)
+	}
+	if err := h.publish(BrokerEvent{Presence: &BrokerPresence{Replica: h.replica, Users: presences}}); err != nil {
+		log.Println(err)
+	}
+}
+
+// Record the presence of users on a replica, and broadcast the users whose
+// presence changed to every client. Must be called from the hub goroutine.
+func (h *Hub) applyPresence(event BrokerPresence) {
+	replica, ok := h.replicas[event.Replica]
+	if !ok {
+		replica = &replicaPresences{users: map[string]ReplicaPresence{}}
+		h.replicas[event.Replica] = replica
+	}
+	replica.updated = time.Now()
+
+	for _, presence := range event.Users {
+		replica.users[presence.Username] = presence
+		h.refreshPresence(presence.Username)
+	}
+}
+
+// Forget the presence of users on replicas that stopped publishing it, which
+// have most likely crashed. Must be called from the hub goroutine.
+func (h *Hub) expirePresence() {
+	for id, replica := range h.replicas {
+		if time.Since(replica.updated) < presenceExpiry {
+			continue
+		}
+		delete(h.replicas, id)
+		for username := range replica.users {
+			h.refreshPresence(username)
+		}
+	}
+}
+
+// Return the presence of a user across every replica: online if online on
+// any replica, otherwise idle if connected to any, and last seen when last
+// active on any. Must be called from the hub goroutine.
+func (h *Hub) presenceOf(username string) Presence {
+	presence := Presence{Username: username, State: presenceOffline}
+
+	var lastActive time.Time
+	for _, replica := range h.replicas {
+		user, ok := replica.users[username]
+		if !ok {
+			continue
+		}
+		if presenceRank[user.State] > presenceRank[presence.State] {
+			presence.State = user.State
+		}
+		if user.LastActive.After(lastActive) {
+			lastActive = user.LastActive
+		}
+	}
+	if presence.State != presenceOnline && !lastActive.IsZero() {
+		presence.LastSeen = &lastActive
+	}
+
+	return presence
+}
+
+// Recompute the presence of a user across every replica, and broadcast it to
+// every client of this replica if it changed. Must be called from the hub
+// goroutine.
+func (h *Hub) refreshPresence(username string) {
+	presence := h.presenceOf(username)
+	if h.states[username] == presence.State {
+		return
+	}
+	h.states[username] = presence.State
+
+	serialized, err := newEnvelope(eventPresenceChanged, presence)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// Every client is subscribed to the default channel.
+	h.deliver(broadcastMessage{channel: defaultChannel, data: serialized})
+}
+
+// Return the presence of every user seen by any replica, sorted by username.
+// Must be called from the hub goroutine.
+func (h *Hub) allPresence() []Presence {
+	presences := make([]Presence, 0, len(h.states))
+	for username := range h.states {
+		presences = append(presences, h.presenceOf(username))
+	}
+	sort.Slice(presences, func(i, j int) bool {
+		return presences[i].Username < presences[j].Username
+	})
+
+	return presences
+}
+
+// Endpoint for getting the presence of every user seen by any replica since
+// the server started.
+func handleGetPresence(s *Server, w http.ResponseWriter, r *http.Request) {
+	request := make(chan []Presence, 1)
+	select {
+	case s.hub.presenceRequests <- request:
+	case <-s.hub.stopped:
+		http.Error(w, "Server is shutting down.", http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, <-request)
+}
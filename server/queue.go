@@ -0,0 +1,205 @@
+// Bounded queues of outbound frames for each client, what to do when a client
+// cannot keep up, and metrics on the frames that are dropped as a result.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Close code sent to clients disconnected for not keeping up with their
+// frames.
+const closeSlowConsumer = 4001
+
+// Returned when publishing an event while the publish queue is full.
+var errPublishQueueFull = errors.New("publish queue is full")
+
+// Counters of the frames and events the server dropped since it started.
+var (
+	framesDropped           atomic.Int64
+	slowConsumerDisconnects atomic.Int64
+	publishesDropped        atomic.Int64
+)
+
+// Body of responses to /admin/metrics.
+type FanoutMetrics struct {
+	// Frames dropped from the queues of clients that did not keep up.
+	FramesDropped int64 `json:"framesDropped"`
+
+	// Connections closed for not keeping up.
+	SlowConsumerDisconnects int64 `json:"slowConsumerDisconnects"`
+
+	// Events not published because the publish queue was full.
+	PublishesDropped int64 `json:"publishesDropped"`
+}
+
+// Endpoint for getting the counters of dropped frames and events.
+func handleGetMetrics(s *Server, w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, FanoutMetrics{
+		FramesDropped:           framesDropped.Load(),
+		SlowConsumerDisconnects: slowConsumerDisconnects.Load(),
+		PublishesDropped:        publishesDropped.Load(),
+	})
+}
+
+// What the hub does when a client's queue is full.
+type overflowPolicy string
+
+const (
+	// Drop the oldest queued frame, and tell the client about the gap with a
+	// gap frame.
+	overflowDropOldest overflowPolicy = "drop_oldest"
+
+	// Close the connection with closeSlowConsumer.
+	overflowDisconnect overflowPolicy = "disconnect"
+)
+
+// Settings of the queues between publishers, the hub, and clients.
+type fanoutConfig struct {
+	// Maximum number of frames queued for each client.
+	QueueSize int
+
+	// What to do when a client's queue is full.
+	Overflow overflowPolicy
+
+	// Maximum number of events waiting to be published through the broker.
+	PublishQueueSize int
+}
+
+// Settings used unless configured otherwise.
+var defaultFanoutConfig = fanoutConfig{
+	QueueSize:        64,
+	Overflow:         overflowDropOldest,
+	PublishQueueSize: 1024,
+}
+
+func (p *overflowPolicy) String() string {
+	if p == nil {
+		return ""
+	}
+	return string(*p)
+}
+
+func (p *overflowPolicy) Set(value string) error {
+	switch policy := overflowPolicy(value); policy {
+	case overflowDropOldest, overflowDisconnect:
+		*p = policy
+		return nil
+	default:
+		return fmt.Errorf("unknown overflow policy: %v", value)
+	}
+}
+
+// Payload of a gap event.
+type GapPayload struct {
+	// Number of frames dropped.
+	Dropped int `json:"dropped"`
+
+	// The sequence number of the last frame dropped from each stream.
+	Streams map[string]int64 `json:"streams,omitempty"`
+}
+
+// A bounded queue of frames from the hub to a client's write goroutine, which
+// never blocks the hub.
+type sendQueue struct {
+	// Guards the fields below.
+	mu sync.Mutex
+
+	frames []outboundFrame
+	size   int
+
+	// The frames dropped since the write goroutine last took frames, which
+	// all came before the frames still queued.
+	gap GapPayload
+
+	closed bool
+
+	// Code and reason of the close frame to send once the queued frames are
+	// sent.
+	closeCode   int
+	closeReason string
+
+	// Signalled when frames are pushed or the queue is closed.
+	ready chan struct{}
+}
+
+// Create a queue that holds at most size frames.
+func newSendQueue(size int) *sendQueue {
+	return &sendQueue{size: size, ready: make(chan struct{}, 1)}
+}
+
+// Wake up the write goroutine. Must be called with q.mu held.
+func (q *sendQueue) notify() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Queue a frame, and return whether there was room for it.
+func (q *sendQueue) push(frame outboundFrame) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.frames) >= q.size {
+		return false
+	}
+	q.frames = append(q.frames, frame)
+	q.notify()
+
+	return true
+}
+
+// Drop the oldest queued frame, recording it in the gap.
+func (q *sendQueue) dropOldest() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.frames) == 0 {
+		return
+	}
+	frame := q.frames[0]
+	q.frames = q.frames[1:]
+
+	q.gap.Dropped++
+	if frame.seq != 0 {
+		if q.gap.Streams == nil {
+			q.gap.Streams = map[string]int64{}
+		}
+		q.gap.Streams[frame.stream] = frame.seq
+	}
+}
+
+// Close the queue, so that the write goroutine sends a close frame with the
+// given code and reason once it has sent the frames already queued.
+func (q *sendQueue) close(code int, reason string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed, q.closeCode, q.closeReason = true, code, reason
+	q.notify()
+}
+
+// Take the queued frames, the frames dropped before them, and whether the
+// queue is closed.
+func (q *sendQueue) take() ([]outboundFrame, GapPayload, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	frames, gap := q.frames, q.gap
+	q.frames, q.gap = nil, GapPayload{}
+
+	return frames, gap, q.closed
+}
+
+// Return the code and reason of the close frame to send once the queue is
+// closed.
+func (q *sendQueue) closeMessage() (int, string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.closeCode, q.closeReason
+}
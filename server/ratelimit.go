@@ -0,0 +1,295 @@
+// Token bucket rate limits per user and per IP address for each class of
+// route and for inbound websocket frames.
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the in-process limiter forgets buckets that have refilled.
+const limiterPruneInterval = time.Minute
+
+// A limit of Burst requests, refilled evenly over Period. The zero value
+// allows everything.
+type RateLimit struct {
+	Burst  int
+	Period time.Duration
+}
+
+// Return whether the limit allows everything.
+func (l RateLimit) disabled() bool {
+	return l.Burst <= 0 || l.Period <= 0
+}
+
+// Parse a rate limit of the form <burst>/<period>, such as 30/1m, or off.
+func parseRateLimit(value string) (RateLimit, error) {
+	if value == "off" {
+		return RateLimit{}, nil
+	}
+	burst, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("expected <burst>/<period> or off")
+	}
+	n, err := strconv.Atoi(burst)
+	if err != nil || n < 1 {
+		return RateLimit{}, fmt.Errorf("invalid burst: %v", burst)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid period: %v", period)
+	}
+
+	return RateLimit{Burst: n, Period: d}, nil
+}
+
+// Format the limit as parseRateLimit expects it.
+func (l RateLimit) String() string {
+	if l.disabled() {
+		return "off"
+	}
+	return fmt.Sprintf("%v/%v", l.Burst, l.Period)
+}
+
+// A class of requests that share rate limits.
+type rateLimitClass string
+
+const (
+	// Signing up, logging in, and refreshing tokens. The per-user limit counts
+	// login attempts for each username.
+	limitAuth rateLimitClass = "auth"
+
+	// Posting messages, over REST or the websocket.
+	limitMessages rateLimitClass = "messages"
+
+	// Voting on, editing, and reacting to messages.
+	limitVotes rateLimitClass = "votes"
+
+	// Every inbound websocket frame.
+	limitFrames rateLimitClass = "frames"
+)
+
+// The limits of a class of requests for each user and each IP address.
+type classLimits struct {
+	User RateLimit
+	IP   RateLimit
+}
+
+// Limits used unless configured otherwise.
+var defaultRateLimits = map[rateLimitClass]classLimits{
+	limitAuth:     {User: RateLimit{10, time.Minute}, IP: RateLimit{30, time.Minute}},
+	limitMessages: {User: RateLimit{30, time.Minute}, IP: RateLimit{120, time.Minute}},
+	limitVotes:    {User: RateLimit{60, time.Minute}, IP: RateLimit{240, time.Minute}},
+	limitFrames:   {User: RateLimit{300, time.Minute}, IP: RateLimit{1200, time.Minute}},
+}
+
+// Limiter counts requests against token buckets identified by keys. The
+// in-process implementation only limits the requests a single server sees,
+// so replicas must share an implementation backed by shared storage.
+type Limiter interface {
+	// Take a token from the bucket with the given key, which holds at most
+	// limit.Burst tokens and refills at limit.Burst per limit.Period. Returns
+	// zero if a token was taken, or how long until one is available.
+	Take(ctx context.Context, key string, limit RateLimit) (time.Duration, error)
+
+	// Return zero if the bucket with the given key holds a token, or how long
+	// until it does, without taking one.
+	Wait(ctx context.Context, key string, limit RateLimit) (time.Duration, error)
+}
+
+// A token bucket, refilled lazily when tokens are taken.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Return the tokens in the bucket at now, refilling it since it was updated.
+func (b *bucket) refill(limit RateLimit, now time.Time) float64 {
+	rate := float64(limit.Burst) / limit.Period.Seconds()
+	return math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*rate)
+}
+
+// Return how long until a bucket holding tokens holds a whole token.
+func untilToken(tokens float64, limit RateLimit) time.Duration {
+	rate := float64(limit.Burst) / limit.Period.Seconds()
+	return time.Duration((1 - tokens) / rate * float64(time.Second))
+}
+
+// A Limiter that keeps buckets in process memory.
+type memoryLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+
+	// The limit each bucket was last used with, to know when it is full.
+	limits map[string]RateLimit
+
+	pruned time.Time
+}
+
+// Create a new in-process limiter.
+func newMemoryLimiter() *memoryLimiter {
+	return &memoryLimiter{
+		buckets: make(map[string]*bucket),
+		limits:  make(map[string]RateLimit),
+		pruned:  time.Now(),
+	}
+}
+
+func (m *memoryLimiter) Take(ctx context.Context, key string, limit RateLimit) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.pruned) > limiterPruneInterval {
+		m.prune(now)
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		m.buckets[key] = b
+	}
+	m.limits[key] = limit
+	b.tokens, b.updated = b.refill(limit, now), now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, nil
+	}
+
+	return untilToken(b.tokens, limit), nil
+}
+
+func (m *memoryLimiter) Wait(ctx context.Context, key string, limit RateLimit) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.buckets[key]
+	if !ok {
+		return 0, nil
+	}
+	if tokens := b.refill(limit, time.Now()); tokens < 1 {
+		return untilToken(tokens, limit), nil
+	}
+
+	return 0, nil
+}
+
+// Forget full buckets, which are the same as missing ones. Must be called
+// with m.mu held.
+func (m *memoryLimiter) prune(now time.Time) {
+	for key, b := range m.buckets {
+		if limit := m.limits[key]; b.refill(limit, now) >= float64(limit.Burst) {
+			delete(m.buckets, key)
+			delete(m.limits, key)
+		}
+	}
+	m.pruned = now
+}
+
+// Return the IP address a request came from: the last address in the trusted
+// proxy header if one is configured, which is the one the nearest proxy added,
+// or else the address of the connection.
+func (s *Server) requestIP(r *http.Request) string {
+	if s.config.TrustedProxyHeader != "" {
+		if values := r.Header.Values(s.config.TrustedProxyHeader); len(values) > 0 {
+			addresses := strings.Split(values[len(values)-1], ",")
+			if ip := net.ParseIP(strings.TrimSpace(addresses[len(addresses)-1])); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Create the error returned when a rate limit is exceeded.
+func newRateLimitError(retryAfter time.Duration) error {
+	return &apiError{
+		status:     http.StatusTooManyRequests,
+		message:    "Too many requests.",
+		retryAfter: retryAfter,
+	}
+}
+
+// Count a request in the class against the user's limit and then the IP
+// address's limit, skipping either if empty. Returns a rate limit error if
+// either is exceeded. A request the user's limit refuses is not counted
+// against the IP address, so that one user cannot exhaust the limit of others
+// behind the same address.
+func (s *Server) takeRateLimit(class rateLimitClass, username string, ip string) error {
+	limits := s.rateLimits[class]
+
+	take := func(key string, limit RateLimit) error {
+		if limit.disabled() {
+			return nil
+		}
+		retryAfter, err := s.limiter.Take(s.ctx, string(class)+":"+key, limit)
+		if err != nil {
+			return err
+		}
+		if retryAfter > 0 {
+			return newRateLimitError(retryAfter)
+		}
+		return nil
+	}
+	if username != "" {
+		if err := take("user:"+username, limits.User); err != nil {
+			return err
+		}
+	}
+	if ip != "" {
+		if err := take("ip:"+ip, limits.IP); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Return a rate limit error if the user's limit in the class is exceeded,
+// without counting a request against it.
+func (s *Server) checkRateLimit(class rateLimitClass, username string) error {
+	limit := s.rateLimits[class].User
+	if limit.disabled() {
+		return nil
+	}
+	wait, err := s.limiter.Wait(s.ctx, string(class)+":user:"+username, limit)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return newRateLimitError(wait)
+	}
+
+	return nil
+}
+
+// Wrap a handler so that it responds with 429 (TOO MANY REQUESTS) when the
+// requests in the class of the user, if authenticated, or of their IP address
+// exceed their limit.
+func (s *Server) rateLimited(class rateLimitClass, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only trust the username of authenticated requests.
+		var username string
+		if claims, ok := r.Context().Value(claimsContextKey{}).(AccessClaims); ok {
+			username = claims.Username
+		}
+		if err := s.takeRateLimit(class, username, s.requestIP(r)); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		handler(w, r)
+	}
+}
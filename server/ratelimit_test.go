@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	for _, value := range []string{"30/1m0s", "1/1s", "off"} {
+		limit, err := parseRateLimit(value)
+		if err != nil {
+			t.Errorf("%v: %v", value, err)
+		} else if limit.String() != value {
+			t.Errorf("%v: parsed as %v", value, limit)
+		}
+	}
+	for _, value := range []string{"", "30", "0/1m", "-1/1m", "x/1m", "30/0s", "30/forever"} {
+		if _, err := parseRateLimit(value); err == nil {
+			t.Errorf("%v: parsed without error", value)
+		}
+	}
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	ctx := context.Background()
+	limiter := newMemoryLimiter()
+	limit := RateLimit{Burst: 2, Period: 200 * time.Millisecond}
+
+	// Waiting on a bucket never takes from it.
+	for i := 0; i < 3; i++ {
+		if wait, err := limiter.Wait(ctx, "a", limit); wait != 0 || err != nil {
+			t.Fatalf("got %v, %v waiting on a full bucket", wait, err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if wait, err := limiter.Take(ctx, "a", limit); wait != 0 || err != nil {
+			t.Fatalf("got %v, %v taking token %v of the burst", wait, err, i+1)
+		}
+	}
+	wait, err := limiter.Take(ctx, "a", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= 0 || wait > 100*time.Millisecond {
+		t.Errorf("got %v after the burst, want at most the time to refill a token", wait)
+	}
+	if waiting, _ := limiter.Wait(ctx, "a", limit); waiting <= 0 {
+		t.Error("an empty bucket did not make Wait wait")
+	}
+	if wait, _ := limiter.Take(ctx, "b", limit); wait != 0 {
+		t.Error("buckets with other keys were limited")
+	}
+
+	// A token is available once the bucket refills.
+	time.Sleep(wait + 10*time.Millisecond)
+	if wait, err := limiter.Take(ctx, "a", limit); wait != 0 || err != nil {
+		t.Errorf("got %v, %v after the bucket refilled", wait, err)
+	}
+}
+
+func TestUntilToken(t *testing.T) {
+	limit := RateLimit{Burst: 10, Period: 10 * time.Second}
+	for _, test := range []struct {
+		tokens float64
+		want   time.Duration
+	}{
+		{0, time.Second},
+		{0.5, 500 * time.Millisecond},
+		{-1, 2 * time.Second},
+	} {
+		if got := untilToken(test.tokens, limit); got != test.want {
+			t.Errorf("untilToken(%v) = %v, want %v", test.tokens, got, test.want)
+		}
+	}
+}
+
+// Only failed logins count against the limit on guesses at a password, and
+// exceeding it blocks logging in even with the right password.
+func TestLoginRateLimit(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.RateLimits[limitAuth] = classLimits{User: RateLimit{Burst: 2, Period: time.Hour}}
+	})
+	signUp(t, s, "alice")
+	for i := 0; i < 3; i++ {
+		logIn(t, s, "alice")
+	}
+
+	for i := 0; i < 2; i++ {
+		w := doRequest(t, s, "POST", "/users/login", "", AuthRequestBody{Username: "alice", Password: "wrong"})
+		decodeResponse(t, w, http.StatusForbidden, nil)
+	}
+	w := doRequest(t, s, "POST", "/users/login", "", AuthRequestBody{Username: "alice", Password: "password"})
+	decodeResponse(t, w, http.StatusTooManyRequests, nil)
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("missing Retry-After header")
+	}
+}
+
+func TestRequestIP(t *testing.T) {
+	for _, test := range []struct {
+		header  string
+		values  []string
+		wantIP  string
+		comment string
+	}{
+		{"", []string{"203.0.113.7"}, "192.0.2.1", "the header is ignored unless trusted"},
+		{"X-Forwarded-For", nil, "192.0.2.1", "requests without the header use the connection"},
+		{"X-Forwarded-For", []string{"203.0.113.7"}, "203.0.113.7", "the proxy's address for the client is used"},
+		{"X-Forwarded-For", []string{"198.51.100.9, 203.0.113.7"}, "203.0.113.7", "addresses the client forged are skipped"},
+		{"X-Forwarded-For", []string{"198.51.100.9", "203.0.113.7"}, "203.0.113.7", "the last of several headers is used"},
+		{"X-Real-IP", []string{"2001:db8::1"}, "2001:db8::1", "IPv6 addresses are accepted"},
+		{"X-Real-IP", []string{"unknown"}, "192.0.2.1", "invalid addresses use the connection"},
+	} {
+		s := &Server{config: defaultConfig()}
+		s.config.TrustedProxyHeader = test.header
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		for _, value := range test.values {
+			r.Header.Add("X-Forwarded-For", value)
+			r.Header.Add("X-Real-IP", value)
+		}
+
+		if ip := s.requestIP(r); ip != test.wantIP {
+			t.Errorf("%v: got %v, want %v", test.comment, ip, test.wantIP)
+		}
+	}
+}
+
+// Requests refused by the user's limit must not use up the IP address's.
+func TestTakeRateLimitUserFirst(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.RateLimits[limitMessages] = classLimits{
+			User: RateLimit{Burst: 1, Period: time.Hour},
+			IP:   RateLimit{Burst: 2, Period: time.Hour},
+		}
+	})
+
+	if err := s.takeRateLimit(limitMessages, "alice", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.takeRateLimit(limitMessages, "alice", "192.0.2.1"); err == nil {
+			t.Fatal("alice exceeded the user limit")
+		}
+	}
+	if err := s.takeRateLimit(limitMessages, "bob", "192.0.2.1"); err != nil {
+		t.Errorf("bob was limited by requests alice was refused: %v", err)
+	}
+	if err := s.takeRateLimit(limitMessages, "carol", "192.0.2.1"); err == nil {
+		t.Error("the IP address exceeded its limit")
+	}
+}
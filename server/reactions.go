@@ -0,0 +1,131 @@
+// Routes for adding and removing emoji reactions to messages.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Maximum length in bytes of a reaction emoji. Long enough for ZWJ sequences
+// such as family emoji.
+const maxEmojiLength = 32
+
+// Usernames of the users who reacted to a message, keyed by emoji, in the
+// order they reacted.
+type Reactions map[string][]string
+
+// Aggregated reactions to a message with a single emoji.
+type Reaction struct {
+	Emoji string   `json:"emoji"`
+	Count int      `json:"count"`
+	Users []string `json:"users"`
+}
+
+// Return the aggregated reaction with the given emoji.
+func (r Reactions) get(emoji string) Reaction {
+	users := r[emoji]
+	if users == nil {
+		users = []string{}
+	}
+	return Reaction{Emoji: emoji, Count: len(users), Users: users}
+}
+
+// Serialize reactions as a list of aggregated reactions sorted by emoji.
+func (r Reactions) MarshalJSON() ([]byte, error) {
+	reactions := []Reaction{}
+	for emoji, users := range r {
+		if len(users) > 0 {
+			reactions = append(reactions, r.get(emoji))
+		}
+	}
+	sort.Slice(reactions, func(i, j int) bool {
+		return reactions[i].Emoji < reactions[j].Emoji
+	})
+
+	return json.Marshal(reactions)
+}
+
+// Return whether s looks like a single emoji. Letters, whitespace, and the
+// characters MongoDB reserves in field names are rejected.
+func isValidEmoji(s string) bool {
+	if s == "" || len(s) > maxEmojiLength || !utf8.ValidString(s) || strings.ContainsAny(s, ".$") {
+		return false
+	}
+
+	symbol := false
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+		if unicode.Is(unicode.So, r) {
+			symbol = true
+		}
+	}
+	return symbol
+}
+
+// Payload of a reaction_changed event.
+type ReactionChangedPayload struct {
+	// ID of the message.
+	ID string `json:"id"`
+
+	// The reaction after the change.
+	Reaction
+}
+
+// Endpoint for reacting to a message with an emoji (idempotent operation).
+func handleAddReaction(s *Server, w http.ResponseWriter, r *http.Request) {
+	handleUpdateReaction(s, w, r, true)
+}
+
+// Endpoint for removing a reaction from a message (idempotent operation).
+func handleRemoveReaction(s *Server, w http.ResponseWriter, r *http.Request) {
+	handleUpdateReaction(s, w, r, false)
+}
+
+// Add or remove the user's reaction, and stream the new aggregate to other
+// clients if it changed.
+func handleUpdateReaction(s *Server, w http.ResponseWriter, r *http.Request, added bool) {
+	vars := mux.Vars(r)
+	id, emoji := vars["id"], vars["emoji"]
+	username := r.Header.Get("username")
+
+	if !isValidEmoji(emoji) {
+		http.Error(w, "Invalid emoji.", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.getLiveMessage(id, username); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var message Message
+	var changed bool
+	var err error
+	if added {
+		message, changed, err = s.store.AddReaction(s.ctx, id, emoji, username)
+	} else {
+		message, changed, err = s.store.RemoveReaction(s.ctx, id, emoji, username)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if changed {
+		payload := ReactionChangedPayload{ID: message.ID, Reaction: message.Reactions.get(emoji)}
+		if err := s.broadcastEvent(message, eventReactionChanged, payload); err != nil {
+			log.Println(err)
+		}
+	}
+
+	log.Printf("successfully updated reaction %v of %v to message %v\n", emoji, username, id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,171 @@
+// Read markers, read receipts, and unread counts.
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The latest message a user has read in a channel or conversation, in the
+// database and over the wire. Also the payload of a read_receipt event.
+type ReadMarker struct {
+	Username string `bson:"username" json:"username"`
+	Target   `bson:",inline"`
+
+	// ID of the latest message read.
+	MessageID string `bson:"messageID" json:"messageID"`
+
+	// Creation time of the latest message read, so that markers can be
+	// compared in history order.
+	MessageCreated time.Time `bson:"messageCreated" json:"-"`
+
+	// When the marker was last moved.
+	Read time.Time `bson:"read" json:"read"`
+}
+
+// Return the cursor pointing at the latest message read.
+func (r ReadMarker) cursor() *messageCursor {
+	return &messageCursor{Created: r.MessageCreated, ID: r.MessageID}
+}
+
+// Number of unread messages in a channel or conversation.
+type UnreadCount struct {
+	Target
+
+	Unread int `json:"unread"`
+
+	// ID of the latest message read, if any.
+	LastRead string `json:"lastRead,omitempty"`
+}
+
+// Move the user's read marker in the message's channel or conversation
+// forward to the message, and send a read receipt if it moved. Markers
+// never move backwards.
+func (s *Server) markRead(username string, id string) error {
+	message, err := s.getVisibleMessage(id, username)
+	if err != nil {
+		return err
+	}
+	if message.ParentID != "" {
+		return newAPIError(http.StatusBadRequest, "Replies cannot be marked as read.")
+	}
+
+	marker := ReadMarker{
+		Username:       username,
+		Target:         message.target(),
+		MessageID:      message.ID,
+		MessageCreated: message.Created,
+		Read:           time.Now(),
+	}
+	advanced, err := s.store.SetReadMarker(s.ctx, marker)
+	if err != nil {
+		return err
+	}
+	if advanced {
+		if err := s.sendReadReceipt(marker); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
+
+// Send an ephemeral read receipt to the reader's own connections, so that they
+// agree on what is unread, and, in a conversation, to the other participants.
+// Receipts in channels are not sent to other members, which would flood busy
+// channels.
+func (s *Server) sendReadReceipt(marker ReadMarker) error {
+	message := broadcastMessage{recipients: []string{marker.Username}}
+	if marker.Target.Conversation != "" {
+		var err error
+		if message, err = s.addressTarget(marker.Target); err != nil {
+			return err
+		}
+	}
+
+	return s.publishEvent(message, "", eventReadReceipt, marker)
+}
+
+// Count the user's unread messages in a channel or conversation. Messages the
+// user posted and deleted messages are never unread.
+func (s *Server) getUnreadCount(username string, target Target) (UnreadCount, error) {
+	count := UnreadCount{Target: target}
+
+	var after *messageCursor
+	marker, err := s.store.GetReadMarker(s.ctx, username, target)
+	if err == nil {
+		after = marker.cursor()
+		count.LastRead = marker.MessageID
+	} else if err != errNotFound {
+		return UnreadCount{}, err
+	}
+
+	count.Unread, err = s.store.CountUnread(s.ctx, username, target, after)
+	if err != nil {
+		return UnreadCount{}, err
+	}
+
+	return count, nil
+}
+
+// Count the user's unread messages in every channel they have joined and
+// every conversation they participate in.
+func (s *Server) getAllUnreadCounts(username string) ([]UnreadCount, error) {
+	targets, err := s.getUserTargets(username)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]UnreadCount, 0, len(targets))
+	for _, target := range targets {
+		count, err := s.getUnreadCount(username, target)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+
+	return counts, nil
+}
+
+// Fill in the user's unread count for the channel or conversation of a page.
+func (s *Server) addUnreadCount(page *MessagePage, username string, target Target) error {
+	count, err := s.getUnreadCount(username, target)
+	if err != nil {
+		return err
+	}
+	page.Unread = &count.Unread
+	page.LastRead = count.LastRead
+
+	return nil
+}
+
+// Endpoint for marking every message up to and including the given one as
+// read.
+func handleMarkRead(s *Server, w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	username := r.Header.Get("username")
+
+	if err := s.markRead(username, id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	log.Printf("%v read up to message %v\n", username, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Endpoint for getting the user's unread counts in every channel they have
+// joined and every conversation they participate in.
+func handleGetUnreadCounts(s *Server, w http.ResponseWriter, r *http.Request) {
+	counts, err := s.getAllUnreadCounts(r.Header.Get("username"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, counts)
+}
@@ -0,0 +1,294 @@
+// Sequence numbers of the events in each stream, and replay of the events a
+// reconnecting client missed.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// How long the hub holds events that arrived before an earlier event of
+	// their stream, waiting for the earlier event.
+	reorderTimeout = 2 * time.Second
+
+	// How often the hub checks for events held longer than reorderTimeout.
+	reorderCheckInterval = 250 * time.Millisecond
+
+	// How long the hub remembers the last event delivered in a stream without
+	// further events.
+	streamOrderRetention = time.Minute
+)
+
+// A sequenced event, stored for replay.
+type StreamEvent struct {
+	Stream string `bson:"stream"`
+	Seq    int64  `bson:"seq"`
+
+	// The serialized envelope.
+	Data []byte `bson:"data"`
+
+	Created time.Time `bson:"created"`
+}
+
+// Payload of a resync event.
+type ResyncPayload struct {
+	Stream string `json:"stream"`
+
+	// The latest sequence number of the stream.
+	Seq int64 `json:"seq"`
+}
+
+// Return the name of the stream of events in a channel or conversation.
+func (t Target) stream() string {
+	if t.Conversation != "" {
+		return "conversation:" + t.Conversation
+	}
+	return "channel:" + t.Channel
+}
+
+// Return the name of the stream of events about the replies to a message.
+func threadStream(id string) string {
+	return "thread:" + id
+}
+
+// Serialize an event and publish it to the clients message is addressed to.
+// Events in a stream are numbered and stored for replay, while events outside
+// of any stream are ephemeral.
+func (s *Server) publishEvent(message broadcastMessage, stream string, eventType string, payload interface{}) error {
+	if stream == "" {
+		serialized, err := newEnvelope(eventType, payload)
+		if err != nil {
+			return err
+		}
+		message.data = serialized
+		return s.hub.publishMessage(message)
+	}
+
+	// Numbering is atomic, so publishers never wait for each other's writes.
+	// Concurrent events of a stream may be stored and published in another
+	// order than they are numbered, which the hubs and replay both tolerate.
+	// An event numbered but never stored leaves a gap, which the hubs and
+	// replay resolve with a resync.
+	seq, err := s.store.NextSequence(s.ctx, stream)
+	if err != nil {
+		return err
+	}
+	serialized, err := newStreamEnvelope(eventType, payload, stream, seq)
+	if err != nil {
+		return err
+	}
+	if err := s.store.SaveStreamEvent(s.ctx, StreamEvent{Stream: stream, Seq: seq, Data: serialized, Created: time.Now()}); err != nil {
+		return err
+	}
+	message.stream, message.seq, message.data = stream, seq, serialized
+	return s.hub.publishMessage(message)
+}
+
+// The order in which the hub delivers the events of a stream. Events are
+// numbered before they are stored and published, so concurrent events may
+// arrive in another order. Events that arrive early are held until the events
+// before them arrive.
+type streamOrder struct {
+	// Sequence number of the last event delivered.
+	delivered int64
+
+	// Events that arrived before an earlier event of the stream, keyed by
+	// sequence number.
+	pending map[int64]broadcastMessage
+
+	// When to stop waiting for the earliest missing event.
+	deadline time.Time
+
+	// When an event of the stream last arrived.
+	received time.Time
+}
+
+// Deliver a sequenced message once every earlier event of its stream has been
+// delivered, so that clients never receive a stream's events out of order.
+func (h *Hub) deliverInOrder(message broadcastMessage) {
+	now := time.Now()
+	order, ok := h.streams[message.stream]
+	if !ok {
+		// Earlier events, if any, were delivered before the hub forgot the
+		// stream.
+		order = &streamOrder{delivered: message.seq - 1, pending: map[int64]broadcastMessage{}}
+		h.streams[message.stream] = order
+	}
+	order.received = now
+
+	switch {
+	case message.seq <= order.delivered:
+		// Later events were already delivered, so clients that received them
+		// cannot resume from them without missing this one.
+		h.resync(message, order.delivered)
+	case message.seq == order.delivered+1:
+		h.deliver(message)
+		order.delivered = message.seq
+		for {
+			next, ok := order.pending[order.delivered+1]
+			if !ok {
+				break
+			}
+			delete(order.pending, next.seq)
+			h.deliver(next)
+			order.delivered = next.seq
+		}
+		order.deadline = now.Add(reorderTimeout)
+	default:
+		if len(order.pending) == 0 {
+			order.deadline = now.Add(reorderTimeout)
+		}
+		order.pending[message.seq] = message
+	}
+}
+
+// Give up on the events that held back others for longer than
+// reorderTimeout, telling the clients of their streams to resync, and forget
+// streams without recent events.
+func (h *Hub) expireStreamOrders(now time.Time) {
+	for stream, order := range h.streams {
+		if len(order.pending) == 0 {
+			if now.Sub(order.received) > streamOrderRetention {
+				delete(h.streams, stream)
+			}
+			continue
+		}
+		if now.Before(order.deadline) {
+			continue
+		}
+
+		var latest broadcastMessage
+		for _, message := range order.pending {
+			if message.seq > latest.seq {
+				latest = message
+			}
+		}
+		h.resync(latest, latest.seq)
+		order.delivered, order.pending = latest.seq, map[int64]broadcastMessage{}
+	}
+}
+
+// Tell the clients a sequenced message is for to refetch its stream, which
+// now ends at seq.
+func (h *Hub) resync(message broadcastMessage, seq int64) {
+	serialized, err := newEnvelope(eventResync, ResyncPayload{Stream: message.stream, Seq: seq})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	message.except, message.stream, message.seq, message.data = "", "", 0, serialized
+	h.deliver(message)
+}
+
+// First message of a websocket connection that resumes streams, instead of a
+// bare JWT.
+type AuthenticationMessage struct {
+	Token string `json:"token"`
+
+	// Sequence number of the last event the client received in each stream
+	// to resume.
+	Resume map[string]int64 `json:"resume"`
+}
+
+// Parse the first message of a websocket connection, which is either a bare
+// JWT or an AuthenticationMessage.
+func parseAuthenticationMessage(data []byte) (AuthenticationMessage, error) {
+	if !strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		return AuthenticationMessage{Token: string(data)}, nil
+	}
+
+	var message AuthenticationMessage
+	err := json.Unmarshal(data, &message)
+	return message, err
+}
+
+// Check that the client may resume each of the streams it asked to, and
+// subscribe it to the threads among them. Returns the streams to replay, and
+// error frames for the others. Must be called before the client is
+// registered.
+func (s *Server) authorizeResume(c *Client) (map[string]int64, [][]byte) {
+	streams := map[string]int64{}
+	var rejections [][]byte
+	for stream, after := range c.resume {
+		kind, id, _ := strings.Cut(stream, ":")
+		var err error
+		allowed := false
+		switch kind {
+		case "channel":
+			allowed = c.channels[id]
+		case "conversation":
+			target := Target{Conversation: id}
+			err = s.ensureTargetAccess(c.username, &target)
+			allowed = err == nil
+		case "thread":
+			_, err = s.getVisibleMessage(id, c.username)
+			allowed = err == nil
+		}
+		if _, ok := err.(*apiError); err != nil && !ok {
+			log.Println(err)
+		}
+		if !allowed {
+			serialized, err := newEnvelope(eventError, ErrorPayload{Message: "Cannot resume " + stream + "."})
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			rejections = append(rejections, serialized)
+			continue
+		}
+
+		if kind == "thread" {
+			c.threads[id] = true
+		}
+		streams[stream] = after
+	}
+
+	return streams, rejections
+}
+
+// Load the events the client missed in each stream after the given sequence
+// numbers, oldest first per stream, and the latest sequence number replayed
+// in each stream. Streams that cannot be replayed in full get a resync event
+// instead, telling the client to refetch them.
+func (s *Server) loadReplay(streams map[string]int64) ([][]byte, map[string]int64, error) {
+	var frames [][]byte
+	replayed := map[string]int64{}
+	for stream, after := range streams {
+		current, err := s.store.GetSequence(s.ctx, stream)
+		if err != nil {
+			return nil, nil, err
+		}
+		if after == current {
+			continue
+		}
+
+		events, err := s.store.GetStreamEvents(s.ctx, stream, after, s.config.MaxReplayEvents+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		complete := after < current && len(events) > 0 && len(events) <= s.config.MaxReplayEvents
+		for i, event := range events {
+			if event.Seq != after+int64(i)+1 {
+				complete = false
+			}
+		}
+		if !complete {
+			serialized, err := newEnvelope(eventResync, ResyncPayload{Stream: stream, Seq: current})
+			if err != nil {
+				return nil, nil, err
+			}
+			frames = append(frames, serialized)
+			continue
+		}
+
+		for _, event := range events {
+			frames = append(frames, event.Data)
+		}
+		replayed[stream] = events[len(events)-1].Seq
+	}
+
+	return frames, replayed, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Take the frames queued for a client, described by their sequence numbers,
+// or, for resync events, by "resync" and the sequence number they give.
+func queuedSeqs(t *testing.T, client *Client) []string {
+	t.Helper()
+
+	frames, _, _ := client.send.take()
+	seqs := []string{}
+	for _, frame := range frames {
+		if frame.seq != 0 {
+			seqs = append(seqs, fmt.Sprint(frame.seq))
+			continue
+		}
+		var envelope Envelope
+		var resync ResyncPayload
+		if err := json.Unmarshal(frame.data, &envelope); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(envelope.Payload, &resync); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, fmt.Sprintf("%v %v", envelope.Type, resync.Seq))
+	}
+
+	return seqs
+}
+
+func TestDeliverInOrder(t *testing.T) {
+	// The hub is not running, so the test owns its state.
+	h := newHub(context.Background(), newMemoryBroker(), defaultFanoutConfig, time.Minute)
+	client := newTestClient(h, "alice")
+	h.clients[client] = true
+	stream := Target{Channel: defaultChannel}.stream()
+	deliver := func(seqs ...int64) {
+		for _, seq := range seqs {
+			h.deliverInOrder(broadcastMessage{channel: defaultChannel, stream: stream, seq: seq})
+		}
+	}
+	check := func(description string, want ...string) {
+		t.Helper()
+		if got := queuedSeqs(t, client); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%v: got %v, want %v", description, got, want)
+		}
+	}
+
+	deliver(1, 3, 4)
+	check("events after a missing one are held", "1")
+	deliver(2)
+	check("held events follow the missing one", "2", "3", "4")
+	deliver(3)
+	check("events already delivered resync", "resync 4")
+
+	deliver(6)
+	now := time.Now()
+	h.expireStreamOrders(now)
+	check("events are held until the reorder timeout")
+	h.expireStreamOrders(now.Add(reorderTimeout + time.Second))
+	check("missing events resync after the reorder timeout", "resync 6")
+	deliver(7)
+	check("events after the resync are delivered", "7")
+
+	h.expireStreamOrders(now.Add(streamOrderRetention + time.Second))
+	if _, ok := h.streams[stream]; ok {
+		t.Error("stream without recent events was not forgotten")
+	}
+}
+
+func TestLoadReplay(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.MaxReplayEvents = 3
+	})
+	stream := Target{Channel: defaultChannel}.stream()
+	publish := func() {
+		t.Helper()
+		if err := s.publishEvent(broadcastMessage{channel: defaultChannel}, stream, eventResync, ResyncPayload{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		publish()
+	}
+	check := func(description string, after int64, want []string, wantReplayed int64) {
+		t.Helper()
+		frames, replayed, err := s.loadReplay(map[string]int64{stream: after})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, frame := range frames {
+			var envelope Envelope
+			var resync ResyncPayload
+			if err := json.Unmarshal(frame, &envelope); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(envelope.Payload, &resync); err != nil {
+				t.Fatal(err)
+			}
+			if envelope.Seq != 0 {
+				got = append(got, fmt.Sprint(envelope.Seq))
+			} else {
+				got = append(got, fmt.Sprintf("%v %v", envelope.Type, resync.Seq))
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) || replayed[stream] != wantReplayed {
+			t.Errorf("%v: got %v replayed to %v, want %v replayed to %v", description, got, replayed[stream], want, wantReplayed)
+		}
+	}
+
+	check("missed events are replayed", 2, []string{"3", "4", "5"}, 5)
+	check("clients up to date get nothing", 5, []string{}, 0)
+	check("too many missed events resync", 1, []string{"resync 5"}, 0)
+	check("clients ahead of the stream resync", 7, []string{"resync 5"}, 0)
+
+	// An event numbered but never stored cannot be replayed.
+	if _, err := s.store.NextSequence(context.Background(), stream); err != nil {
+		t.Fatal(err)
+	}
+	publish()
+	check("missing events resync", 5, []string{"resync 7"}, 0)
+}
@@ -0,0 +1,202 @@
+// Roles, the permissions they grant, and routes for granting and revoking
+// them.
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// A role held by a user. Every user implicitly holds roleUser, and may be
+// granted the others.
+type Role string
+
+const (
+	roleUser      Role = "user"
+	roleModerator Role = "moderator"
+	roleAdmin     Role = "admin"
+)
+
+// An action that only users holding certain roles may take.
+type Permission string
+
+const (
+	// Act against other users and their messages.
+	permModerate Permission = "moderate"
+
+	// Grant and revoke roles.
+	permManageRoles Permission = "manage_roles"
+)
+
+// The permissions granted by each role.
+var rolePermissions = map[Role][]Permission{
+	roleUser:      {},
+	roleModerator: {permModerate},
+	roleAdmin:     {permModerate, permManageRoles},
+}
+
+// Return whether a role can be granted.
+func isGrantableRole(role Role) bool {
+	return role == roleModerator || role == roleAdmin
+}
+
+// Return every role of a user with the given granted roles, including the
+// implicit roleUser.
+func allRoles(granted []Role) []Role {
+	return append([]Role{roleUser}, granted...)
+}
+
+// Return whether any of the roles grants the permission.
+func hasPermission(roles []Role, permission Permission) bool {
+	for _, role := range roles {
+		for _, p := range rolePermissions[role] {
+			if p == permission {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Return the set of usernames that are granted roleAdmin.
+func (s *Server) adminUsernames() map[string]bool {
+	admins := map[string]bool{}
+	for _, username := range s.config.AdminUsernames {
+		admins[username] = true
+	}
+
+	return admins
+}
+
+// Grant roleAdmin to the configured admin usernames that already exist. Users
+// listed that sign up later are granted it then.
+func (s *Server) bootstrapAdmins() {
+	for username := range s.adminUsernames() {
+		granted, err := s.store.AddUserRole(s.ctx, username, roleAdmin)
+		if err != nil {
+			if err != errNotFound {
+				log.Fatal(err)
+			}
+			continue
+		}
+		if granted {
+			log.Printf("Granted %v to %v\n", roleAdmin, username)
+		}
+	}
+}
+
+// Return an error unless the user holds a role granting the permission, both
+// in their access token and currently, so that revoking a role takes effect
+// immediately.
+func (s *Server) ensurePermission(claims AccessClaims, permission Permission) error {
+	missing := newAPIError(http.StatusForbidden, "Missing permission: "+string(permission)+".")
+	if !hasPermission(claims.Roles, permission) {
+		return missing
+	}
+
+	user, err := s.store.GetUser(s.ctx, claims.Username)
+	if err == errNotFound {
+		return missing
+	}
+	if err != nil {
+		return err
+	}
+	if !hasPermission(allRoles(user.Roles), permission) {
+		return missing
+	}
+
+	return nil
+}
+
+// Returns middleware rejecting requests unless the user holds a role granting
+// the permission, as checked by ensurePermission. Must be used after
+// authenticationMiddleware.
+func (s *Server) permissionMiddleware(permission Permission) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := s.ensurePermission(requestClaims(r), permission); err != nil {
+				writeError(w, err)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Roles of a user returned by the admin API.
+type UserRoles struct {
+	Username string `json:"username"`
+	Roles    []Role `json:"roles"`
+}
+
+// Endpoint for getting the roles of a user.
+func handleGetUserRoles(s *Server, w http.ResponseWriter, r *http.Request) {
+	user, err := s.store.GetUser(s.ctx, mux.Vars(r)["username"])
+	if err != nil {
+		if err == errNotFound {
+			http.Error(w, "User not found.", http.StatusNotFound)
+			return
+		}
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, UserRoles{Username: user.Username, Roles: allRoles(user.Roles)})
+}
+
+// Endpoint for granting a role to a user.
+func handleGrantRole(s *Server, w http.ResponseWriter, r *http.Request) {
+	handleUpdateRole(s, w, r, true)
+}
+
+// Endpoint for revoking a role from a user.
+func handleRevokeRole(s *Server, w http.ResponseWriter, r *http.Request) {
+	handleUpdateRole(s, w, r, false)
+}
+
+// Grant or revoke the role in the URL. The user's new roles are included in
+// their access tokens from their next refresh.
+func handleUpdateRole(s *Server, w http.ResponseWriter, r *http.Request, grant bool) {
+	vars := mux.Vars(r)
+	target, role := vars["username"], Role(vars["role"])
+	username := r.Header.Get("username")
+
+	if !isGrantableRole(role) {
+		http.Error(w, "Invalid role.", http.StatusBadRequest)
+		return
+	}
+	if !grant && role == roleAdmin && target == username {
+		// Keep at least one admin around to grant the role back.
+		http.Error(w, "Admins cannot revoke their own admin role.", http.StatusBadRequest)
+		return
+	}
+
+	var changed bool
+	var err error
+	if grant {
+		changed, err = s.store.AddUserRole(s.ctx, target, role)
+	} else {
+		changed, err = s.store.RemoveUserRole(s.ctx, target, role)
+	}
+	if err != nil {
+		if err == errNotFound {
+			http.Error(w, "User not found.", http.StatusNotFound)
+			return
+		}
+		writeError(w, err)
+		return
+	}
+
+	if changed {
+		if grant {
+			log.Printf("%v granted %v to %v\n", username, role, target)
+		} else {
+			log.Printf("%v revoked %v from %v\n", username, role, target)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,393 @@
+// Full-text search of message content.
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// Maximum length of a snippet in runes.
+	maxSnippetLength = 160
+
+	// Number of runes of context to keep before the first match when a
+	// snippet is truncated.
+	snippetLeadingContext = 40
+)
+
+// Which messages to return from a search.
+type SearchQuery struct {
+	// Lowercase tokens that must all appear in the content.
+	Terms []string
+
+	// Phrases that must all appear verbatim in the content as whole words,
+	// ignoring case.
+	Phrases []SearchPhrase
+
+	// If set, only return messages posted by this user.
+	Author string
+
+	// If set, only return messages created at or after this time.
+	Since *time.Time
+
+	// If set, only return messages created strictly before this time.
+	Until *time.Time
+
+	// The channels and conversations to search.
+	Targets []Target
+
+	// Cursors and maximum number of messages, as in MessageQuery.
+	Before *messageCursor
+	After  *messageCursor
+	Limit  int
+}
+
+// A phrase to search for.
+type SearchPhrase struct {
+	// Lowercase text of the phrase.
+	Text string
+
+	// Matches the phrase as whole words, ignoring case.
+	pattern *regexp.Regexp
+}
+
+// Create a phrase to search for, compiling the pattern that matches it.
+func newSearchPhrase(text string) SearchPhrase {
+	return SearchPhrase{Text: text, pattern: regexp.MustCompile("(?i)" + wordsPattern(text))}
+}
+
+// Return whether the message satisfies every filter of the query other than
+// the cursors.
+func (q SearchQuery) matches(message Message) bool {
+	if q.Author != "" && message.Author != q.Author {
+		return false
+	}
+	if q.Since != nil && message.Created.Before(*q.Since) {
+		return false
+	}
+	if q.Until != nil && !message.Created.Before(*q.Until) {
+		return false
+	}
+
+	inTarget := false
+	for _, target := range q.Targets {
+		if message.target() == target {
+			inTarget = true
+			break
+		}
+	}
+	if !inTarget {
+		return false
+	}
+
+	tokens := map[string]bool{}
+	for _, token := range tokenize(message.Content) {
+		tokens[token] = true
+	}
+	for _, term := range q.Terms {
+		if !tokens[term] {
+			return false
+		}
+	}
+	for _, phrase := range q.Phrases {
+		if !phrase.pattern.MatchString(message.Content) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Characters that separate words: the delimiters of MongoDB text indexes, so
+// that the text index finds every message the memory store would.
+var wordDelimiters = []*unicode.RangeTable{
+	unicode.Dash,
+	unicode.Hyphen,
+	unicode.Pattern_Syntax,
+	unicode.Quotation_Mark,
+	unicode.Terminal_Punctuation,
+	unicode.White_Space,
+}
+
+// Return whether r separates words.
+func isDelimiter(r rune) bool {
+	return unicode.In(r, wordDelimiters...)
+}
+
+// Regular expression character class matching the characters that separate
+// words.
+var delimiterClass = func() string {
+	var b strings.Builder
+	b.WriteString("[")
+	add := func(lo, hi, stride uint32) {
+		if stride == 1 {
+			fmt.Fprintf(&b, `\x{%x}-\x{%x}`, lo, hi)
+			return
+		}
+		for r := lo; r <= hi; r += stride {
+			fmt.Fprintf(&b, `\x{%x}`, r)
+		}
+	}
+	for _, table := range wordDelimiters {
+		for _, r := range table.R16 {
+			add(uint32(r.Lo), uint32(r.Hi), uint32(r.Stride))
+		}
+		for _, r := range table.R32 {
+			add(r.Lo, r.Hi, r.Stride)
+		}
+	}
+	b.WriteString("]")
+	return b.String()
+}()
+
+// Split text into lowercase tokens separated by delimiters.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), isDelimiter)
+}
+
+// Return a regular expression matching text as whole words, split the way
+// tokenize splits content. The syntax is shared by Go and MongoDB.
+func wordsPattern(text string) string {
+	runes := []rune(text)
+
+	pattern := regexp.QuoteMeta(text)
+	if len(runes) > 0 && !isDelimiter(runes[0]) {
+		pattern = "(^|" + delimiterClass + ")" + pattern
+	}
+	if len(runes) > 0 && !isDelimiter(runes[len(runes)-1]) {
+		pattern += "(" + delimiterClass + "|$)"
+	}
+	return pattern
+}
+
+// Parse a date filter, either a date or an RFC 3339 time.
+func parseSearchTime(value string) (time.Time, bool) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// Parse a search string into query. Quoted text is a phrase, and from:,
+// after:, and before: filter by author and creation time. Everything else is
+// split into terms.
+func parseSearch(q string, query *SearchQuery) error {
+	parts := strings.Split(q, `"`)
+	if len(parts)%2 == 0 {
+		return newAPIError(http.StatusBadRequest, "Unterminated phrase in search.")
+	}
+
+	for i, part := range parts {
+		// Parts at odd indices were between quotes.
+		if i%2 == 1 {
+			phrase := strings.Join(strings.Fields(strings.ToLower(part)), " ")
+			if phrase != "" {
+				query.Phrases = append(query.Phrases, newSearchPhrase(phrase))
+			}
+			continue
+		}
+
+		for _, word := range strings.Fields(part) {
+			key, value, ok := strings.Cut(word, ":")
+			if !ok || value == "" {
+				query.Terms = append(query.Terms, tokenize(word)...)
+				continue
+			}
+
+			switch key {
+			case "from":
+				query.Author = value
+			case "after", "before":
+				t, ok := parseSearchTime(value)
+				if !ok {
+					return newAPIError(http.StatusBadRequest, "Invalid "+key+" date in search: "+value+".")
+				}
+				if key == "after" {
+					query.Since = &t
+				} else {
+					query.Until = &t
+				}
+			default:
+				query.Terms = append(query.Terms, tokenize(word)...)
+			}
+		}
+	}
+
+	if len(query.Terms) == 0 && len(query.Phrases) == 0 && query.Author == "" && query.Since == nil && query.Until == nil {
+		return newAPIError(http.StatusBadRequest, "Empty search.")
+	}
+	return nil
+}
+
+// Return the ranges of runes in content matched by the query's terms and
+// phrases, sorted and merged.
+func matchRanges(content []rune, query SearchQuery) [][2]int {
+	lower := make([]rune, len(content))
+	for i, r := range content {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	ranges := [][2]int{}
+	terms := map[string]bool{}
+	for _, term := range query.Terms {
+		terms[term] = true
+	}
+	start := -1
+	for i := 0; i <= len(lower); i++ {
+		if i < len(lower) && !isDelimiter(lower[i]) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 && terms[string(lower[start:i])] {
+			ranges = append(ranges, [2]int{start, i})
+		}
+		start = -1
+	}
+	for _, phrase := range query.Phrases {
+		runes := []rune(phrase.Text)
+		for i := 0; i+len(runes) <= len(lower); i++ {
+			if string(lower[i:i+len(runes)]) == phrase.Text {
+				ranges = append(ranges, [2]int{i, i + len(runes)})
+			}
+		}
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	merged := [][2]int{}
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r[0] <= merged[n-1][1] {
+			if r[1] > merged[n-1][1] {
+				merged[n-1][1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// Return an HTML-escaped excerpt of the message around its first match, with
+// matches wrapped in <mark> tags.
+func snippet(content string, query SearchQuery) string {
+	runes := []rune(content)
+	ranges := matchRanges(runes, query)
+
+	start, end := 0, len(runes)
+	if end > maxSnippetLength {
+		if len(ranges) > 0 && ranges[0][0] > snippetLeadingContext {
+			start = ranges[0][0] - snippetLeadingContext
+		}
+		end = start + maxSnippetLength
+		if end > len(runes) {
+			start, end = len(runes)-maxSnippetLength, len(runes)
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	position := start
+	for _, r := range ranges {
+		if r[1] <= start || r[0] >= end {
+			continue
+		}
+		from, to := r[0], r[1]
+		if from < start {
+			from = start
+		}
+		if to > end {
+			to = end
+		}
+		b.WriteString(html.EscapeString(string(runes[position:from])))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(string(runes[from:to])))
+		b.WriteString("</mark>")
+		position = to
+	}
+	b.WriteString(html.EscapeString(string(runes[position:end])))
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+
+	return b.String()
+}
+
+// A message matching a search.
+type SearchResult struct {
+	Message
+
+	// HTML-escaped excerpt of the content with matches wrapped in <mark> tags.
+	Snippet string `json:"snippet"`
+}
+
+// Messages matching a search, paginated like MessagePage.
+type SearchPage struct {
+	Messages   []SearchResult `json:"messages"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+// Endpoint for searching the messages in every channel the user has joined
+// and every conversation they participate in, or in the channel or
+// conversation given as a query parameter.
+func handleSearchMessages(s *Server, w http.ResponseWriter, r *http.Request) {
+	username := r.Header.Get("username")
+	params := r.URL.Query()
+	log.Printf("%v searching for %q.\n", username, params.Get("q"))
+
+	var query SearchQuery
+	if err := parseSearch(params.Get("q"), &query); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	target := Target{Channel: params.Get("channel"), Conversation: params.Get("conversation")}
+	if target != (Target{}) {
+		if err := s.ensureTargetAccess(username, &target); err != nil {
+			writeError(w, err)
+			return
+		}
+		query.Targets = []Target{target}
+	} else {
+		targets, err := s.getUserTargets(username)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		query.Targets = targets
+	}
+
+	pageQuery := MessageQuery{}
+	if err := s.parsePageParameters(r, &pageQuery); err != nil {
+		writeError(w, err)
+		return
+	}
+	query.Before, query.After, query.Limit = pageQuery.Before, pageQuery.After, pageQuery.Limit
+
+	messages, more, err := s.store.SearchMessages(s.ctx, query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	page := SearchPage{Messages: make([]SearchResult, 0, len(messages))}
+	for _, message := range messages {
+		page.Messages = append(page.Messages, SearchResult{Message: message, Snippet: snippet(message.Content, query)})
+	}
+	page.NextCursor = nextCursor(messages, more, query.After != nil)
+
+	writeJSON(w, http.StatusOK, page)
+}
@@ -3,31 +3,29 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // The server struct encapsulates the entire state of the backend, including
 // both the websocket used for real-time chat and the REST API for the control
 // plane.
 type Server struct {
-	// The connection to the MongoDB database.
-	dbClient *mongo.Client
+	// Settings of every subsystem.
+	config *Config
 
-	// The database used for this application.
-	db *mongo.Database
-
-	// The users collection in the database.
-	users *mongo.Collection
-
-	// The messages collection in the database.
-	messages *mongo.Collection
+	// The storage backend for users and messages.
+	store Store
 
 	// The context for the database connection.
 	ctx context.Context
@@ -35,101 +33,247 @@ type Server struct {
 	// Hub encapsulating websocket connections to server.
 	hub *Hub
 
+	// Fans events out to the hubs of every replica.
+	broker Broker
+
+	// Users who are typing.
+	typing *typingTracker
+
+	// Keys for signing and verifying access tokens.
+	keys *keyring
+
+	// Counts requests against rateLimits.
+	limiter    Limiter
+	rateLimits map[rateLimitClass]classLimits
+
 	// Multiplexer for handling routing.
 	router *mux.Router
+
+	// Closed when the server starts shutting down, to refuse new websocket
+	// connections.
+	stopping chan struct{}
+
+	// Closed once in-flight requests have finished during shutdown, to stop
+	// background tasks.
+	done chan struct{}
 }
 
-// Create a new server.
-func newServer() *Server {
+// Create a new server with the given configuration.
+func newServer(config *Config) *Server {
 	ctx := context.TODO()
-	client := connectToDatabase(ctx)
-	db := client.Database("admin")
-
-	return &Server{
-		dbClient: client,
-		db:       db,
-		users:    db.Collection("users"),
-		messages: db.Collection("messages"),
-		ctx:      ctx,
-		hub:      newHub(),
-		router:   mux.NewRouter(),
+	store := newStore(ctx, config)
+
+	// Make sure the default channel exists.
+	err := store.CreateChannel(ctx, Channel{Name: defaultChannel, Created: time.Now()})
+	if err != nil && err != errAlreadyExists {
+		log.Fatal(err)
 	}
+
+	broker := newBroker(ctx, config)
+	s := &Server{
+		config: config,
+		store:  store,
+		ctx:    ctx,
+		hub:    newHub(ctx, broker, config.Fanout, config.IdleTimeout),
+		broker: broker,
+		keys:   newKeyring(config),
+		router: mux.NewRouter(),
+
+		limiter:    newMemoryLimiter(),
+		rateLimits: config.RateLimits,
+		stopping:   make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	s.typing = newTypingTracker(s)
+	s.bootstrapAdmins()
+
+	return s
 }
 
 // Set up the routes in our API.
 func (s Server) setUpRoutes() {
 	// CORS
-	s.router.Use(corsMiddleware)
+	s.router.Use(s.corsMiddleware)
 
 	// Users API.
 	s.router.Path("/users/signup").
 		Methods("POST").
-		HandlerFunc(s.wrapHandler(handleSignup))
+		HandlerFunc(s.rateLimited(limitAuth, s.wrapHandler(handleSignup)))
 	s.router.Path("/users/login").
 		Methods("POST").
-		HandlerFunc(s.wrapHandler(handleLogin))
+		HandlerFunc(s.rateLimited(limitAuth, s.wrapHandler(handleLogin)))
+	s.router.Path("/users/refresh").
+		Methods("POST").
+		HandlerFunc(s.rateLimited(limitAuth, s.wrapHandler(handleRefresh)))
+	s.router.Path("/.well-known/jwks.json").
+		Methods("GET").
+		HandlerFunc(s.wrapHandler(handleGetJWKS))
+
+	// Session API.
+	sessionsRouter := s.router.NewRoute().Subrouter()
+	sessionsRouter.Use(s.authenticationMiddleware)
+	sessionsRouter.Path("/users/logout").
+		Methods("POST", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleLogout))
+	sessionsRouter.Path("/users/logout/all").
+		Methods("POST", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleLogoutAll))
 
 	// Messsages API.
 	messagesRouter := s.router.NewRoute().Subrouter()
-	messagesRouter.Use(authenticationMiddleware)
+	messagesRouter.Use(s.authenticationMiddleware)
 	messagesRouter.Path("/messages").
 		Methods("GET", "OPTIONS").
 		HandlerFunc(s.wrapHandler(handleGetAllMessages))
 	messagesRouter.Path("/messages").
 		Methods("POST", "OPTIONS").
-		HandlerFunc(s.wrapHandler(handleCreateMessage))
+		HandlerFunc(s.rateLimited(limitMessages, s.wrapHandler(handleCreateMessage)))
+	messagesRouter.Path("/messages/search").
+		Methods("GET", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleSearchMessages))
 	messagesRouter.Path("/messages/{id}").
 		Methods("PATCH", "OPTIONS").
-		HandlerFunc(s.wrapHandler(handleUpdateMessage))
+		HandlerFunc(s.rateLimited(limitVotes, s.wrapHandler(handleUpdateMessage)))
+	messagesRouter.Path("/messages/{id}").
+		Methods("DELETE", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleDeleteMessage))
+	messagesRouter.Path("/messages/{id}/reactions/{emoji}").
+		Methods("PUT", "OPTIONS").
+		HandlerFunc(s.rateLimited(limitVotes, s.wrapHandler(handleAddReaction)))
+	messagesRouter.Path("/messages/{id}/reactions/{emoji}").
+		Methods("DELETE", "OPTIONS").
+		HandlerFunc(s.rateLimited(limitVotes, s.wrapHandler(handleRemoveReaction)))
+	messagesRouter.Path("/messages/{id}/read").
+		Methods("POST", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleMarkRead))
+	messagesRouter.Path("/messages/{id}/replies").
+		Methods("GET", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleGetReplies))
+	messagesRouter.Path("/messages/{id}/revisions").
+		Methods("GET", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleGetMessageRevisions))
+
+	// Channels API.
+	channelsRouter := s.router.NewRoute().Subrouter()
+	channelsRouter.Use(s.authenticationMiddleware)
+	channelsRouter.Path("/channels").
+		Methods("GET", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleGetAllChannels))
+	channelsRouter.Path("/channels").
+		Methods("POST", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleCreateChannel))
+	channelsRouter.Path("/channels/{name}/join").
+		Methods("POST", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleJoinChannel))
+	channelsRouter.Path("/channels/{name}/leave").
+		Methods("POST", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleLeaveChannel))
+
+	// Conversations API.
+	conversationsRouter := s.router.NewRoute().Subrouter()
+	conversationsRouter.Use(s.authenticationMiddleware)
+	conversationsRouter.Path("/conversations").
+		Methods("GET", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleGetAllConversations))
+	conversationsRouter.Path("/conversations").
+		Methods("POST", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleCreateConversation))
+	conversationsRouter.Path("/conversations/{id}/messages").
+		Methods("GET", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleGetConversationMessages))
+
+	// Unread counts API.
+	unreadRouter := s.router.NewRoute().Subrouter()
+	unreadRouter.Use(s.authenticationMiddleware)
+	unreadRouter.Path("/unread").
+		Methods("GET", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleGetUnreadCounts))
+
+	// Presence API.
+	presenceRouter := s.router.NewRoute().Subrouter()
+	presenceRouter.Use(s.authenticationMiddleware)
+	presenceRouter.Path("/presence").
+		Methods("GET", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleGetPresence))
+
+	// Moderation API.
+	moderationRouter := s.router.NewRoute().Subrouter()
+	moderationRouter.Use(s.authenticationMiddleware, s.permissionMiddleware(permModerate))
+	moderationRouter.Path("/moderation/users/{username}/ban").
+		Methods("POST", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleBanUser))
+	moderationRouter.Path("/moderation/users/{username}/unban").
+		Methods("POST", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleUnbanUser))
+	moderationRouter.Path("/moderation/users/{username}/mute").
+		Methods("POST", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleMuteUser))
+	moderationRouter.Path("/moderation/users/{username}/unmute").
+		Methods("POST", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleUnmuteUser))
+	moderationRouter.Path("/moderation/messages/{id}/remove").
+		Methods("POST", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleRemoveMessage))
+	moderationRouter.Path("/moderation/actions").
+		Methods("GET", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleGetModerationActions))
+
+	// Admin API.
+	adminRouter := s.router.NewRoute().Subrouter()
+	adminRouter.Use(s.authenticationMiddleware, s.permissionMiddleware(permManageRoles))
+	adminRouter.Path("/admin/users/{username}/roles").
+		Methods("GET", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleGetUserRoles))
+	adminRouter.Path("/admin/users/{username}/roles/{role}").
+		Methods("PUT", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleGrantRole))
+	adminRouter.Path("/admin/users/{username}/roles/{role}").
+		Methods("DELETE", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleRevokeRole))
+	adminRouter.Path("/admin/metrics").
+		Methods("GET", "OPTIONS").
+		HandlerFunc(s.wrapHandler(handleGetMetrics))
 
 	// Websocket for real-time chat.
-	s.router.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		// w.Header().Set("Access-Control-Allow-Origin", "*")
-		serveWs(s.hub, w, r)
-	})
+	s.router.HandleFunc("/ws", s.wrapHandler(serveWs))
 }
 
-// Begin serving the routes associated with the server's mux.
+// Begin serving the routes associated with the server's mux, until the
+// process is asked to terminate.
 func (s Server) start() {
-	defer func() {
-		log.Println("Disconnecting MongoDB client.")
-		if err := s.dbClient.Disconnect(s.ctx); err != nil {
-			log.Fatal(err)
-		}
-	}()
-
 	fmt.Println("Starting server.")
 	go s.hub.run()
-	log.Fatal(http.ListenAndServe("0.0.0.0:8000", s.router))
-}
+	purged := make(chan struct{})
+	go func() {
+		defer close(purged)
+		s.purgeTombstones(s.config.TombstoneRetention)
+	}()
 
-// Creates a connection to the database and returns the corresponding Client.
-func connectToDatabase(ctx context.Context) *mongo.Client {
-	username := os.Getenv("MONGO_INITDB_ROOT_USERNAME")
-	password := os.Getenv("MONGO_INITDB_ROOT_PASSWORD")
-	if username == "" {
-		log.Fatal("mongoDB username environment variable not defined.")
-	}
-	if password == "" {
-		log.Fatal("mongoDB password environment variable not defined.")
-	}
-	credentials := options.Credential{
-		Username: username,
-		Password: password,
+	httpServer := &http.Server{Addr: s.config.Addr, Handler: s.router}
+	failed := make(chan error, 1)
+	go func() {
+		failed <- httpServer.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	var err error
+	select {
+	case sig := <-signals:
+		log.Printf("Received %v, shutting down.\n", sig)
+	case err = <-failed:
 	}
-	options := options.Client().ApplyURI("mongodb://db-service:27017/admin").SetAuth(credentials)
-	client, err := mongo.Connect(ctx, options)
+
+	s.shutdown(httpServer, purged)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Println("MongoDB client successfully connected.")
-
-	return client
 }
 
-func corsMiddleware(next http.Handler) http.Handler {
+// Allow cross-origin requests from the configured origin.
+func (s *Server) corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+		w.Header().Set("Access-Control-Allow-Origin", s.config.CORSOrigin)
 		w.Header().Set("Access-Control-Allow-Headers", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "*")
 
@@ -142,6 +286,55 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// An error that is safe to show to clients, along with the HTTP status that
+// best describes it.
+type apiError struct {
+	status  int
+	message string
+
+	// How long the client should wait before retrying, if set.
+	retryAfter time.Duration
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+// Create a new error that is safe to show to clients.
+func newAPIError(status int, message string) error {
+	return &apiError{status: status, message: message}
+}
+
+// Write an error response, using the status of err if it is an apiError.
+func writeError(w http.ResponseWriter, err error) {
+	if apiErr, ok := err.(*apiError); ok {
+		if apiErr.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(apiErr.retryAfter.Seconds()))))
+		}
+		http.Error(w, apiErr.message, apiErr.status)
+		return
+	}
+
+	log.Println(err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// Serialize v as the JSON body of a response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	serialized, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(serialized); err != nil {
+		log.Println(err)
+	}
+}
+
 func (s *Server) wrapHandler(handler func(s *Server, w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		handler(s, w, r)
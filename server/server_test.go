@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Create a server backed by the memory store and broker, with its hub running
+// and without rate limits on authentication. configure, if set, may change the
+// configuration first.
+func newTestServer(t *testing.T, configure func(config *Config)) *Server {
+	t.Helper()
+
+	config := defaultConfig()
+	config.StorageBackend = "memory"
+	config.BcryptCost = bcrypt.MinCost
+	config.AdminUsernames = []string{"admin"}
+	if err := config.flags().Set("rate-limit-auth-ip", "off"); err != nil {
+		t.Fatal(err)
+	}
+	if configure != nil {
+		configure(config)
+	}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newServer(config)
+	s.setUpRoutes()
+	go s.hub.run()
+	t.Cleanup(func() {
+		s.hub.stop(context.Background())
+	})
+
+	return s
+}
+
+// Send a request to the server, with a JSON body unless body is nil, and
+// authenticated with token unless it is empty.
+func doRequest(t *testing.T, s *Server, method string, path string, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := httptest.NewRequest(method, path, &buf)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, r)
+
+	return w
+}
+
+// Decode the JSON body of a response into v, failing unless it has the given
+// status.
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder, status int, v interface{}) {
+	t.Helper()
+
+	if w.Code != status {
+		t.Fatalf("got status %v, want %v: %v", w.Code, status, w.Body.String())
+	}
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Sign up a user, and return their access token.
+func signUp(t *testing.T, s *Server, username string) string {
+	t.Helper()
+
+	var tokens TokenResponse
+	w := doRequest(t, s, "POST", "/users/signup", "", AuthRequestBody{Username: username, Password: "password"})
+	decodeResponse(t, w, http.StatusCreated, &tokens)
+
+	return tokens.AccessToken
+}
+
+// Log in as an existing user, and return their access token.
+func logIn(t *testing.T, s *Server, username string) string {
+	t.Helper()
+
+	var tokens TokenResponse
+	w := doRequest(t, s, "POST", "/users/login", "", AuthRequestBody{Username: username, Password: "password"})
+	decodeResponse(t, w, http.StatusOK, &tokens)
+
+	return tokens.AccessToken
+}
+
+// Post messages to the default channel, and return the latest page of it.
+func postMessages(t *testing.T, s *Server, token string, contents ...string) MessagePage {
+	t.Helper()
+
+	for _, content := range contents {
+		w := doRequest(t, s, "POST", "/messages", token, CreateMessageRequestBody{Content: content})
+		decodeResponse(t, w, http.StatusNoContent, nil)
+	}
+
+	var page MessagePage
+	decodeResponse(t, doRequest(t, s, "GET", "/messages", token, nil), http.StatusOK, &page)
+	return page
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t, nil)
+	signUp(t, s, "alice")
+
+	var tokens TokenResponse
+	w := doRequest(t, s, "POST", "/users/login", "", AuthRequestBody{Username: "alice", Password: "password"})
+	decodeResponse(t, w, http.StatusOK, &tokens)
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Errorf("missing tokens: %+v", tokens)
+	}
+	if tokens.ExpiresIn != int(s.config.AccessTokenLifetime.Seconds()) {
+		t.Errorf("got expiresIn %v, want %v", tokens.ExpiresIn, s.config.AccessTokenLifetime.Seconds())
+	}
+
+	w = doRequest(t, s, "POST", "/users/login", "", AuthRequestBody{Username: "alice", Password: "wrong"})
+	decodeResponse(t, w, http.StatusForbidden, nil)
+}
+
+func TestGetMessagesPageSize(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.DefaultPageSize = 2
+		config.MaxPageSize = 3
+	})
+	token := signUp(t, s, "alice")
+
+	page := postMessages(t, s, token, "one", "two", "three")
+	if len(page.Messages) != 2 || page.NextCursor == "" {
+		t.Errorf("got %v messages and cursor %q, want 2 and a cursor", len(page.Messages), page.NextCursor)
+	}
+
+	decodeResponse(t, doRequest(t, s, "GET", "/messages?limit=3", token, nil), http.StatusOK, &page)
+	if len(page.Messages) != 3 {
+		t.Errorf("got %v messages, want 3", len(page.Messages))
+	}
+
+	decodeResponse(t, doRequest(t, s, "GET", "/messages?limit=4", token, nil), http.StatusBadRequest, nil)
+}
+
+func TestDeleteMessage(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := signUp(t, s, "alice")
+	bob := signUp(t, s, "bob")
+	admin := signUp(t, s, "admin")
+
+	// A moderator whose role is revoked cannot use their unexpired token.
+	signUp(t, s, "mod")
+	if _, err := s.store.AddUserRole(context.Background(), "mod", roleModerator); err != nil {
+		t.Fatal(err)
+	}
+	mod := logIn(t, s, "mod")
+	if _, err := s.store.RemoveUserRole(context.Background(), "mod", roleModerator); err != nil {
+		t.Fatal(err)
+	}
+
+	page := postMessages(t, s, alice, "hello")
+	id := page.Messages[0].ID
+	reason := ModerationRequestBody{Reason: "spam"}
+
+	decodeResponse(t, doRequest(t, s, "DELETE", "/messages/"+id, bob, reason), http.StatusForbidden, nil)
+	decodeResponse(t, doRequest(t, s, "DELETE", "/messages/"+id, mod, reason), http.StatusForbidden, nil)
+	decodeResponse(t, doRequest(t, s, "DELETE", "/messages/"+id, admin, nil), http.StatusBadRequest, nil)
+	decodeResponse(t, doRequest(t, s, "DELETE", "/messages/"+id, admin, reason), http.StatusNoContent, nil)
+
+	message, err := s.store.GetMessage(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Deleted == nil || message.DeletedBy != "admin" || message.Content != "" {
+		t.Errorf("message was not deleted by admin: %+v", message)
+	}
+
+	actions, err := s.store.GetModerationActions(context.Background(), "alice", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 1 || actions[0].Type != actionRemoveMessage || actions[0].MessageID != id || actions[0].Reason != "spam" {
+		t.Errorf("got moderation actions %+v, want the removal of %v for spam", actions, id)
+	}
+
+	// Authors delete their own messages without a reason.
+	id = postMessages(t, s, bob, "bye").Messages[1].ID
+	decodeResponse(t, doRequest(t, s, "DELETE", "/messages/"+id, bob, nil), http.StatusNoContent, nil)
+}
@@ -0,0 +1,58 @@
+// Graceful shutdown of the server, draining requests and connections.
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+// Reason of the close frame sent to websocket clients when the server shuts
+// down, telling them to reconnect and resume their streams.
+const reconnectReason = "reconnect"
+
+// Stop accepting connections, tell websocket clients to reconnect, wait for
+// in-flight requests and the transactions they make to finish, stop the hub,
+// and release the broker and the store. purged is closed once the tombstone
+// purge has stopped.
+func (s *Server) shutdown(httpServer *http.Server, purged <-chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+	close(s.stopping)
+
+	// Shutdown stops accepting connections at once, then waits for requests,
+	// but not for websocket connections.
+	drained := make(chan error, 1)
+	go func() {
+		drained <- httpServer.Shutdown(ctx)
+	}()
+
+	log.Println("Closing websocket connections.")
+	if err := s.hub.closeConnections(ctx); err != nil {
+		log.Printf("Gave up waiting for websocket connections: %v\n", err)
+	}
+	log.Println("Waiting for in-flight requests.")
+	if err := <-drained; err != nil {
+		log.Printf("Gave up waiting for in-flight requests: %v\n", err)
+	}
+
+	close(s.done)
+	select {
+	case <-purged:
+	case <-ctx.Done():
+		log.Println("Gave up waiting for tombstone purge.")
+	}
+
+	log.Println("Stopping hub.")
+	if err := s.hub.stop(ctx); err != nil {
+		log.Printf("Gave up waiting for hub: %v\n", err)
+	}
+	log.Println("Closing broker.")
+	if err := s.broker.Close(); err != nil {
+		log.Println(err)
+	}
+	log.Println("Disconnecting storage backend.")
+	if err := s.store.Disconnect(s.ctx); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,199 @@
+// The storage interface that the server depends on.
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// Returned by a store when the requested user, message, channel, or
+// conversation does not exist.
+var errNotFound = errors.New("not found")
+
+// Returned by a store when creating a channel whose name is taken.
+var errAlreadyExists = errors.New("already exists")
+
+// Store abstracts over the database used to persist users, messages, channels,
+// conversations, read markers, refresh tokens, revoked tokens, moderation
+// actions, and the events of each stream so that the server can run against
+// MongoDB or entirely in memory.
+type Store interface {
+	// Insert a new user.
+	CreateUser(ctx context.Context, user User) error
+
+	// Get the user with the given username, or errNotFound.
+	GetUser(ctx context.Context, username string) (User, error)
+
+	// Persist the upvoted and downvoted sets of the given user.
+	UpdateUserVotes(ctx context.Context, user User) error
+
+	// Grant a role to the user, returning whether they did not already hold
+	// it, or errNotFound.
+	AddUserRole(ctx context.Context, username string, role Role) (bool, error)
+
+	// Revoke a role from the user, returning whether they held it, or
+	// errNotFound.
+	RemoveUserRole(ctx context.Context, username string, role Role) (bool, error)
+
+	// Ban or unban the user, or return errNotFound.
+	SetUserBanned(ctx context.Context, username string, banned bool) error
+
+	// Set when the user's mute ends, or unmute them if until is nil, or
+	// return errNotFound.
+	SetUserMutedUntil(ctx context.Context, username string, until *time.Time) error
+
+	// Insert a record of a moderation action.
+	CreateModerationAction(ctx context.Context, action ModerationAction) error
+
+	// Get the latest moderation actions against the given user, or against
+	// anyone if username is empty, newest first.
+	GetModerationActions(ctx context.Context, username string, limit int) ([]ModerationAction, error)
+
+	// Remove the given messages from every user's upvoted and downvoted sets.
+	RemoveVotes(ctx context.Context, ids []string) error
+
+	// Insert a new refresh token.
+	CreateRefreshToken(ctx context.Context, token RefreshToken) error
+
+	// Mark the refresh token with the given ID as used unless it already is,
+	// and return it as it was before, or errNotFound.
+	UseRefreshToken(ctx context.Context, id string, used time.Time) (RefreshToken, error)
+
+	// Delete every refresh token in the given family.
+	RevokeRefreshTokenFamily(ctx context.Context, family string) error
+
+	// Get the distinct families of the given user's refresh tokens.
+	GetUserSessions(ctx context.Context, username string) ([]string, error)
+
+	// Revoke the access tokens with the given IDs, or issued in the sessions
+	// with the given IDs. Revocations may be forgotten after expires, once the
+	// tokens have expired anyway.
+	RevokeTokens(ctx context.Context, ids []string, expires time.Time) error
+
+	// Return whether any of the given token or session IDs has been revoked.
+	AreTokensRevoked(ctx context.Context, ids []string) (bool, error)
+
+	// Increment the sequence number of the given stream, starting from zero,
+	// and return the new value. Atomic without a transaction, so concurrent
+	// callers always get distinct numbers.
+	NextSequence(ctx context.Context, stream string) (int64, error)
+
+	// Get the latest sequence number of the given stream, or zero if none has
+	// been assigned.
+	GetSequence(ctx context.Context, stream string) (int64, error)
+
+	// Insert a sequenced event. Events of a stream may be inserted in another
+	// order than they were numbered. Events may be forgotten after
+	// replay-retention.
+	SaveStreamEvent(ctx context.Context, event StreamEvent) error
+
+	// Get up to limit of the events in the given stream with sequence numbers
+	// greater than after, in order.
+	GetStreamEvents(ctx context.Context, stream string, after int64, limit int) ([]StreamEvent, error)
+
+	// Get a page of the messages matching the query in chronological order,
+	// and whether more messages lie beyond the page.
+	GetMessages(ctx context.Context, query MessageQuery) ([]Message, bool, error)
+
+	// Get a page of the messages matching the search in chronological order,
+	// and whether more messages lie beyond the page. Deleted messages never
+	// match.
+	SearchMessages(ctx context.Context, query SearchQuery) ([]Message, bool, error)
+
+	// Get the message with the given ID, or errNotFound.
+	GetMessage(ctx context.Context, id string) (Message, error)
+
+	// Insert a new message and return its ID.
+	CreateMessage(ctx context.Context, message Message) (string, error)
+
+	// Replace the content of a message, recording the prior content as a
+	// revision, and return the updated message, or errNotFound if there is
+	// no such message or it has been deleted.
+	EditMessage(ctx context.Context, id string, content string, edited time.Time) (Message, error)
+
+	// Replace a message with a tombstone recording who deleted it, clearing
+	// its content, revisions, and reactions, and return the tombstone or
+	// errNotFound.
+	DeleteMessage(ctx context.Context, id string, deletedBy string, deleted time.Time) (Message, error)
+
+	// Permanently remove tombstones of messages deleted before the given time,
+	// and return their IDs.
+	PurgeMessages(ctx context.Context, deletedBefore time.Time) ([]string, error)
+
+	// Increment the reply count of a message, move its latest reply time
+	// forward to replied if later, and return the updated message or
+	// errNotFound.
+	AddReply(ctx context.Context, id string, replied time.Time) (Message, error)
+
+	// Add a user to the users who reacted to a message with an emoji, and
+	// return the updated message and whether it changed, or errNotFound.
+	AddReaction(ctx context.Context, id string, emoji string, username string) (Message, bool, error)
+
+	// Remove a user from the users who reacted to a message with an emoji,
+	// and return the updated message and whether it changed, or errNotFound.
+	RemoveReaction(ctx context.Context, id string, emoji string, username string) (Message, bool, error)
+
+	// Add n to the vote count of the given message, or return errNotFound.
+	UpdateMessageVotes(ctx context.Context, id string, n int) error
+
+	// Insert or move forward a user's read marker in a channel or
+	// conversation, and return whether it moved. Markers never move backwards.
+	SetReadMarker(ctx context.Context, marker ReadMarker) (bool, error)
+
+	// Get a user's read marker in a channel or conversation, or errNotFound.
+	GetReadMarker(ctx context.Context, username string, target Target) (ReadMarker, error)
+
+	// Count the messages in a channel or conversation that are not replies,
+	// deleted, or posted by the given user, and lie after the cursor if it is
+	// set.
+	CountUnread(ctx context.Context, username string, target Target, after *messageCursor) (int, error)
+
+	// Insert a new channel, or return errAlreadyExists.
+	CreateChannel(ctx context.Context, channel Channel) error
+
+	// Get the channel with the given name, or errNotFound.
+	GetChannel(ctx context.Context, name string) (Channel, error)
+
+	// Get every channel.
+	GetAllChannels(ctx context.Context) ([]Channel, error)
+
+	// Add a user to a channel's members (idempotent operation).
+	AddChannelMember(ctx context.Context, name string, username string) error
+
+	// Remove a user from a channel's members (idempotent operation).
+	RemoveChannelMember(ctx context.Context, name string, username string) error
+
+	// Get the names of the channels the given user has joined.
+	GetUserChannels(ctx context.Context, username string) ([]string, error)
+
+	// Get the conversation between the given conversation's participants,
+	// inserting it if none exists yet.
+	GetOrCreateConversation(ctx context.Context, conversation Conversation) (Conversation, error)
+
+	// Get the conversation with the given ID, or errNotFound.
+	GetConversation(ctx context.Context, id string) (Conversation, error)
+
+	// Get every conversation the given user participates in.
+	GetUserConversations(ctx context.Context, username string) ([]Conversation, error)
+
+	// Execute f atomically. Store calls made with the context passed to f are
+	// part of the transaction, and are rolled back if f returns an error.
+	// Called with the context of a transaction, f joins that transaction.
+	ExecuteAsTransaction(ctx context.Context, f func(ctx context.Context) error) error
+
+	// Release any resources held by the store.
+	Disconnect(ctx context.Context) error
+}
+
+// Create the store selected by the configuration.
+func newStore(ctx context.Context, config *Config) Store {
+	switch config.StorageBackend {
+	case "memory":
+		log.Println("Using in-memory storage backend.")
+		return newMemoryStore(config.ReplayRetention)
+	default:
+		return newMongoStore(ctx, config)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Run a test against every Store: the memory store, and the MongoDB store if
+// MONGO_TEST_URI is set. Each MongoDB test gets a database of its own, which
+// is dropped afterwards.
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryStore(defaultConfig().ReplayRetention))
+	})
+	t.Run("mongo", func(t *testing.T) {
+		uri := os.Getenv("MONGO_TEST_URI")
+		if uri == "" {
+			t.Skip("MONGO_TEST_URI is not set")
+		}
+		config := defaultConfig()
+		config.MongoURI = uri
+		config.MongoUsername = os.Getenv("MONGO_INITDB_ROOT_USERNAME")
+		config.MongoPassword = os.Getenv("MONGO_INITDB_ROOT_PASSWORD")
+		config.MongoDatabase = "test_" + primitive.NewObjectID().Hex()
+
+		ctx := context.Background()
+		store := newMongoStore(ctx, config)
+		t.Cleanup(func() {
+			store.client.Database(config.MongoDatabase).Drop(ctx)
+			store.Disconnect(ctx)
+		})
+		test(t, store)
+	})
+}
+
+// Post messages with the given contents to the default channel, one second
+// apart, and return their IDs.
+func createTestMessages(t *testing.T, store Store, contents ...string) []string {
+	t.Helper()
+
+	created := time.Now().Add(-time.Hour)
+	ids := []string{}
+	for i, content := range contents {
+		message := Message{
+			Author:  "alice",
+			Channel: defaultChannel,
+			Content: content,
+			Created: created.Add(time.Duration(i) * time.Second),
+		}
+		id, err := store.CreateMessage(context.Background(), message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func TestSearchMessages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ids := createTestMessages(t, store,
+			"I am running late",
+			"The run was fun",
+			"foo-bar BAZ",
+			"Run, forest!",
+			"snake_case",
+		)
+
+		tests := []struct {
+			name    string
+			terms   []string
+			phrases []string
+			want    []string
+		}{
+			{name: "whole words only", terms: []string{"run"}, want: []string{ids[1], ids[3]}},
+			{name: "no stemming", terms: []string{"running"}, want: []string{ids[0]}},
+			{name: "no stop words", terms: []string{"the"}, want: []string{ids[1]}},
+			{name: "every term", terms: []string{"run", "fun"}, want: []string{ids[1]}},
+			{name: "split on punctuation", terms: []string{"foo", "baz"}, want: []string{ids[2]}},
+			{name: "phrase", phrases: []string{"run was"}, want: []string{ids[1]}},
+			{name: "phrase of whole words only", phrases: []string{"unning l"}, want: []string{}},
+			{name: "phrase with symbols", phrases: []string{"run, forest"}, want: []string{ids[3]}},
+			{name: "underscores join words", terms: []string{"snake"}, want: []string{}},
+			{name: "word with underscores", terms: []string{"snake_case"}, want: []string{ids[4]}},
+			{name: "no match", terms: []string{"walk"}, want: []string{}},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				query := SearchQuery{
+					Terms:   test.terms,
+					Targets: []Target{{Channel: defaultChannel}},
+					Limit:   10,
+				}
+				for _, phrase := range test.phrases {
+					query.Phrases = append(query.Phrases, newSearchPhrase(phrase))
+				}
+				messages, _, err := store.SearchMessages(context.Background(), query)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got := map[string]bool{}
+				for _, message := range messages {
+					got[message.ID] = true
+				}
+				if len(got) != len(test.want) {
+					t.Fatalf("got %v messages, want %v", len(got), len(test.want))
+				}
+				for _, id := range test.want {
+					if !got[id] {
+						t.Errorf("missing message %v", id)
+					}
+				}
+			})
+		}
+	})
+}
+
+// The regular expressions phrases are searched with must agree with tokenize,
+// which terms are searched with.
+func TestWordsPatternMatchesTokenize(t *testing.T) {
+	contents := []string{"running", "run", "Run, forest!", "foo_bar", "x-run-y", "café", "run2", "über RUN", "run🙂", "«run»"}
+	for _, token := range []string{"run", "foo", "foo_bar", "café", "über"} {
+		pattern := regexp.MustCompile("(?i)" + wordsPattern(token))
+		for _, content := range contents {
+			want := false
+			for _, t := range tokenize(content) {
+				want = want || t == token
+			}
+			if got := pattern.MatchString(content); got != want {
+				t.Errorf("%q in %q: regex matched %v, tokenize %v", token, content, got, want)
+			}
+		}
+	}
+}
+
+// A failed transaction must leave no trace of its writes.
+func TestTransactionRollback(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		if err := store.CreateUser(ctx, User{Username: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+		ids := createTestMessages(t, store, "hello")
+		id := ids[0]
+
+		errRollback := errors.New("rollback")
+		err := store.ExecuteAsTransaction(ctx, func(ctx context.Context) error {
+			if _, err := store.AddUserRole(ctx, "alice", roleModerator); err != nil {
+				return err
+			}
+			if err := store.SetUserBanned(ctx, "alice", true); err != nil {
+				return err
+			}
+			if _, err := store.EditMessage(ctx, id, "edited", time.Now()); err != nil {
+				return err
+			}
+			if _, _, err := store.AddReaction(ctx, id, "👍", "alice"); err != nil {
+				return err
+			}
+			if err := store.UpdateMessageVotes(ctx, id, 1); err != nil {
+				return err
+			}
+			return errRollback
+		})
+		if err != errRollback {
+			t.Fatalf("got error %v, want %v", err, errRollback)
+		}
+
+		user, err := store.GetUser(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(user.Roles) != 0 || user.Banned {
+			t.Errorf("user has roles %v and banned %v, want neither", user.Roles, user.Banned)
+		}
+		message, err := store.GetMessage(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Content != "hello" || message.Edited != nil || len(message.Reactions) != 0 || message.Votes != 0 {
+			t.Errorf("message was not rolled back: %+v", message)
+		}
+	})
+}
+
+// A transaction started inside another joins it, and is rolled back with it.
+func TestNestedTransaction(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		if err := store.CreateUser(ctx, User{Username: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+
+		errRollback := errors.New("rollback")
+		err := store.ExecuteAsTransaction(ctx, func(ctx context.Context) error {
+			err := store.ExecuteAsTransaction(ctx, func(ctx context.Context) error {
+				return store.SetUserBanned(ctx, "alice", true)
+			})
+			if err != nil {
+				return err
+			}
+			return errRollback
+		})
+		if err != errRollback {
+			t.Fatalf("got error %v, want %v", err, errRollback)
+		}
+
+		user, err := store.GetUser(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Banned {
+			t.Error("write of the inner transaction was not rolled back")
+		}
+	})
+}
+
+// Deleted messages cannot be edited, even by callers that fetched them before
+// they were deleted.
+func TestEditDeletedMessage(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		id := createTestMessages(t, store, "hello")[0]
+		if _, err := store.DeleteMessage(ctx, id, "alice", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := store.EditMessage(ctx, id, "edited", time.Now()); err != errNotFound {
+			t.Fatalf("got error %v, want %v", err, errNotFound)
+		}
+		message, err := store.GetMessage(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Content != "" || len(message.Revisions) != 0 {
+			t.Errorf("tombstone was edited: %+v", message)
+		}
+	})
+}
+
+// Events are numbered and saved outside of transactions, so concurrent
+// publishers may save them in another order than they were numbered.
+func TestStreamEventsOutOfOrder(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		const n = 20
+		var wg sync.WaitGroup
+		seqs := make(chan int64, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				seq, err := store.NextSequence(ctx, "channel:test")
+				if err != nil {
+					t.Error(err)
+				}
+				seqs <- seq
+			}()
+		}
+		wg.Wait()
+		close(seqs)
+
+		// Save the events latest first.
+		numbered := map[int64]bool{}
+		for seq := range seqs {
+			numbered[seq] = true
+		}
+		for seq := int64(n); seq > 0; seq-- {
+			if !numbered[seq] {
+				t.Fatalf("sequence number %v was not assigned", seq)
+			}
+			if err := store.SaveStreamEvent(ctx, StreamEvent{Stream: "channel:test", Seq: seq, Created: time.Now()}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		events, err := store.GetStreamEvents(ctx, "channel:test", 5, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != n-5 {
+			t.Fatalf("got %v events, want %v", len(events), n-5)
+		}
+		for i, event := range events {
+			if event.Seq != int64(i)+6 {
+				t.Errorf("got event %v at %v, want %v", event.Seq, i, i+6)
+			}
+		}
+	})
+}
+
+// Rolling back a transaction of the memory store must only undo the fields
+// it wrote, keeping writes made outside the transaction in the meantime.
+func TestMemoryRollbackKeepsOtherWrites(t *testing.T) {
+	store := newMemoryStore(defaultConfig().ReplayRetention)
+	ctx := context.Background()
+	if err := store.CreateUser(ctx, User{Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateChannel(ctx, Channel{Name: "random"}); err != nil {
+		t.Fatal(err)
+	}
+	id := createTestMessages(t, store, "hello")[0]
+
+	errRollback := errors.New("rollback")
+	err := store.ExecuteAsTransaction(ctx, func(txCtx context.Context) error {
+		if _, err := store.AddUserRole(txCtx, "alice", roleModerator); err != nil {
+			return err
+		}
+		if _, err := store.EditMessage(txCtx, id, "edited", time.Now()); err != nil {
+			return err
+		}
+		if _, _, err := store.AddReaction(txCtx, id, "👍", "alice"); err != nil {
+			return err
+		}
+		if err := store.AddChannelMember(txCtx, "random", "alice"); err != nil {
+			return err
+		}
+
+		// Writes outside the transaction, which commit at once.
+		if err := store.SetUserBanned(ctx, "alice", true); err != nil {
+			return err
+		}
+		if _, err := store.AddUserRole(ctx, "alice", roleAdmin); err != nil {
+			return err
+		}
+		if _, _, err := store.AddReaction(ctx, id, "👍", "bob"); err != nil {
+			return err
+		}
+		if err := store.UpdateMessageVotes(ctx, id, 1); err != nil {
+			return err
+		}
+		if err := store.AddChannelMember(ctx, "random", "bob"); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("got error %v, want %v", err, errRollback)
+	}
+
+	user, err := store.GetUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Banned {
+		t.Error("ban made outside the transaction was rolled back")
+	}
+	if len(user.Roles) != 1 || user.Roles[0] != roleAdmin {
+		t.Errorf("got roles %v, want [%v]", user.Roles, roleAdmin)
+	}
+
+	message, err := store.GetMessage(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Content != "hello" {
+		t.Errorf("got content %q, want %q", message.Content, "hello")
+	}
+	if users := message.Reactions["👍"]; len(users) != 1 || users[0] != "bob" {
+		t.Errorf("got reactions %v, want only bob's", message.Reactions)
+	}
+	if message.Votes != 1 {
+		t.Errorf("got %v votes, want 1", message.Votes)
+	}
+
+	channel, err := store.GetChannel(ctx, "random")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channel.Members) != 1 || channel.Members[0] != "bob" {
+		t.Errorf("got members %v, want [bob]", channel.Members)
+	}
+}
+
+// Rolling back a moderation action must keep actions recorded outside the
+// transaction after it.
+func TestMemoryRollbackKeepsLaterModerationActions(t *testing.T) {
+	store := newMemoryStore(defaultConfig().ReplayRetention)
+	ctx := context.Background()
+
+	errRollback := errors.New("rollback")
+	err := store.ExecuteAsTransaction(ctx, func(txCtx context.Context) error {
+		if err := store.CreateModerationAction(txCtx, ModerationAction{Type: actionBan, Target: "alice"}); err != nil {
+			return err
+		}
+		if err := store.CreateModerationAction(ctx, ModerationAction{Type: actionMute, Target: "bob"}); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("got error %v, want %v", err, errRollback)
+	}
+
+	actions, err := store.GetModerationActions(ctx, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 1 || actions[0].Target != "bob" {
+		t.Errorf("got actions %+v, want only bob's mute", actions)
+	}
+}
+
+// The character class in patterns must match exactly the delimiters tokenize
+// splits on.
+func TestDelimiterClassMatchesIsDelimiter(t *testing.T) {
+	class := regexp.MustCompile("^" + delimiterClass + "$")
+	for r := rune(0); r <= 0x10000; r++ {
+		if got, want := class.MatchString(string(r)), isDelimiter(r); got != want {
+			t.Errorf("%U: class matched %v, isDelimiter %v", r, got, want)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// Routes for threaded replies to messages.
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Endpoint for getting a page of the replies to a message. Replies are posted
+// through the create message endpoint with a parentID.
+func handleGetReplies(s *Server, w http.ResponseWriter, r *http.Request) {
+	query := MessageQuery{ParentID: mux.Vars(r)["id"]}
+	log.Printf("Getting replies to message %v.\n", query.ParentID)
+
+	if _, err := s.getVisibleMessage(query.ParentID, r.Header.Get("username")); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.parsePageParameters(r, &query); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	page, err := s.getMessagePage(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
@@ -0,0 +1,154 @@
+// Refresh tokens, which are exchanged for new short-lived access tokens.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Representation of a refresh token in the database. Each refresh token can be
+// used once, and is rotated for a new one in the same family.
+type RefreshToken struct {
+	// SHA-256 hash of the token, so that the database never holds usable
+	// tokens.
+	ID string `bson:"_id"`
+
+	Username string `bson:"username"`
+
+	// Shared by every token rotated from the same login, and used as the ID
+	// of the login's session. If a used token is presented again, the whole
+	// session is revoked.
+	Family string `bson:"family"`
+
+	Created time.Time `bson:"created"`
+	Expires time.Time `bson:"expires"`
+
+	// When the token was rotated, if it has been.
+	Used *time.Time `bson:"used,omitempty"`
+}
+
+// Tokens returned by the signup, login, and refresh endpoints.
+type TokenResponse struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+
+	// Seconds until the access token expires.
+	ExpiresIn int `json:"expiresIn"`
+
+	// The user's unread counts in every channel and conversation. Only
+	// returned by signup and login.
+	Unread []UnreadCount `json:"unread,omitempty"`
+}
+
+// Return the hash under which a refresh token is stored.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue an access token and a refresh token in the given family for the user.
+// The refresh token expires at expires.
+func (s *Server) issueTokens(username string, family string, expires time.Time) (TokenResponse, error) {
+	user, err := s.store.GetUser(s.ctx, username)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	if user.Banned {
+		return TokenResponse{}, newAPIError(http.StatusForbidden, "Account is banned.")
+	}
+	accessToken, err := s.generateJWT(username, family, user.Roles)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return TokenResponse{}, err
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(secret)
+	err = s.store.CreateRefreshToken(s.ctx, RefreshToken{
+		ID:       hashRefreshToken(refreshToken),
+		Username: username,
+		Family:   family,
+		Created:  time.Now(),
+		Expires:  expires,
+	})
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	return TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(s.config.AccessTokenLifetime.Seconds()),
+	}, nil
+}
+
+// Issue tokens for a new login, starting a new refresh token family, along
+// with the user's unread counts.
+func (s *Server) login(username string) (TokenResponse, error) {
+	tokens, err := s.issueTokens(username, primitive.NewObjectID().Hex(), time.Now().Add(s.config.RefreshTokenLifetime))
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	// Catch the client up on what the user missed while logged out.
+	tokens.Unread, err = s.getAllUnreadCounts(username)
+	return tokens, err
+}
+
+// Body of request to the refresh endpoint.
+type RefreshRequestBody struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Endpoint for exchanging a refresh token for a new access token and refresh
+// token.
+func handleRefresh(s *Server, w http.ResponseWriter, r *http.Request) {
+	var body RefreshRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	old, err := s.store.UseRefreshToken(s.ctx, hashRefreshToken(body.RefreshToken), time.Now())
+	if err != nil {
+		if err == errNotFound {
+			http.Error(w, "Invalid refresh token.", http.StatusUnauthorized)
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	if old.Used != nil {
+		// Someone is replaying a rotated token, so it may have been stolen.
+		// Log the session descended from it out.
+		log.Printf("Refresh token reused for %v, revoking family %v\n", old.Username, old.Family)
+		if err := s.revokeSessions([]string{old.Family}); err != nil {
+			log.Println(err)
+		}
+		http.Error(w, "Invalid refresh token.", http.StatusUnauthorized)
+		return
+	}
+	if time.Now().After(old.Expires) {
+		http.Error(w, "Refresh token has expired.", http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := s.issueTokens(old.Username, old.Family, old.Expires)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	log.Printf("Refreshed tokens for %v\n", old.Username)
+	writeJSON(w, http.StatusOK, tokens)
+}
@@ -0,0 +1,111 @@
+// Tracking of which users are typing, so that typing indicators expire.
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// A user typing in a channel or conversation.
+type typingKey struct {
+	username string
+	target   Target
+}
+
+// Tracks which users are typing where, and broadcasts when they start and
+// stop.
+type typingTracker struct {
+	server *Server
+
+	// Guards timers.
+	mu sync.Mutex
+
+	// Orders the events published, so that the last event published for
+	// each key is its current state.
+	publishMu sync.Mutex
+
+	// Timers that expire the typing state of each user who is typing.
+	timers map[typingKey]*time.Timer
+}
+
+// Create a new typing tracker for the server.
+func newTypingTracker(s *Server) *typingTracker {
+	return &typingTracker{server: s, timers: make(map[typingKey]*time.Timer)}
+}
+
+// Record that a user is typing, broadcasting if they just started, and push
+// back the time their typing state expires.
+func (t *typingTracker) start(username string, target Target) {
+	key := typingKey{username: username, target: target}
+
+	t.mu.Lock()
+	timer, typing := t.timers[key]
+	if typing {
+		timer.Stop()
+	}
+	timer = time.AfterFunc(t.server.config.TypingTimeout, func() {
+		t.mu.Lock()
+		// A newer timer replaced this one if the user kept typing.
+		expired := t.timers[key] == timer
+		if expired {
+			delete(t.timers, key)
+		}
+		t.mu.Unlock()
+
+		if expired {
+			t.broadcast(key, false)
+		}
+	})
+	t.timers[key] = timer
+	t.mu.Unlock()
+
+	if !typing {
+		t.broadcast(key, true)
+	}
+}
+
+// Record that a user stopped typing, broadcasting if they were typing.
+func (t *typingTracker) stop(username string, target Target) {
+	key := typingKey{username: username, target: target}
+
+	t.mu.Lock()
+	timer, typing := t.timers[key]
+	if typing {
+		timer.Stop()
+		delete(t.timers, key)
+	}
+	t.mu.Unlock()
+
+	if typing {
+		t.broadcast(key, false)
+	}
+}
+
+// Tell everyone but the user that they started or stopped typing, unless
+// their state changed again in the meantime. Must be called without t.mu
+// held, as addressing a conversation reaches the store and publishing may
+// wait for the broker.
+func (t *typingTracker) broadcast(key typingKey, typing bool) {
+	message, err := t.server.addressTarget(key.target)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	message.except = key.username
+
+	// A change of state after the check broadcasts again once this returns,
+	// so the last event published for the key is always its current state.
+	t.publishMu.Lock()
+	defer t.publishMu.Unlock()
+	t.mu.Lock()
+	_, current := t.timers[key]
+	t.mu.Unlock()
+	if current != typing {
+		return
+	}
+	payload := TypingPayload{Username: key.username, Target: key.target, Typing: typing}
+	if err := t.server.publishEvent(message, "", eventTyping, payload); err != nil {
+		log.Println(err)
+	}
+}
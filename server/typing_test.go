@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Wait for the next n typing events queued for a client, failing after a
+// second.
+func typingEvents(t *testing.T, client *Client, n int) []TypingPayload {
+	t.Helper()
+
+	var events []TypingPayload
+	deadline := time.After(time.Second)
+	for {
+		frames, _, _ := client.send.take()
+		for _, frame := range frames {
+			var envelope Envelope
+			if err := json.Unmarshal(frame.data, &envelope); err != nil {
+				t.Fatal(err)
+			}
+			if envelope.Type != eventTyping {
+				continue
+			}
+			var payload TypingPayload
+			if err := json.Unmarshal(envelope.Payload, &payload); err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, payload)
+		}
+		if len(events) >= n {
+			return events
+		}
+
+		select {
+		case <-client.send.ready:
+		case <-deadline:
+			t.Fatalf("got typing events %+v, want %v", events, n)
+		}
+	}
+}
+
+func TestTyping(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.TypingTimeout = 50 * time.Millisecond
+	})
+	bob := newTestClient(s.hub, "bob")
+	if !s.hub.registerClient(bob) {
+		t.Fatal("registration refused")
+	}
+	target := Target{Channel: defaultChannel}
+
+	// Typing expires after the timeout.
+	s.typing.start("alice", target)
+	events := typingEvents(t, bob, 2)
+	if len(events) != 2 || events[0].Username != "alice" || !events[0].Typing || events[1].Typing {
+		t.Errorf("got %+v, want alice to start and stop typing", events)
+	}
+
+	// Typing again does not broadcast again, and stopping broadcasts
+	// immediately, once.
+	s.typing.start("alice", target)
+	s.typing.start("alice", target)
+	s.typing.stop("alice", target)
+	s.typing.stop("alice", target)
+	events = typingEvents(t, bob, 2)
+	time.Sleep(100 * time.Millisecond)
+	frames, _, _ := bob.send.take()
+	if len(events) != 2 || !events[0].Typing || events[1].Typing || len(frames) != 0 {
+		t.Errorf("got %+v and %v more frames, want alice to start and stop typing", events, len(frames))
+	}
+}
@@ -6,19 +6,22 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// Number of iterations bcrypt will use to hash the password.
-const BCRYPT_ITERATIONS = 12
-
 // Custom JWT claims so that we can extract the username of the user.
 type JwtClaims struct {
 	Username string `json:"username"`
+
+	// ID of the session the token was issued in.
+	Session string `json:"sid"`
+
+	// Roles the user held when the token was issued.
+	Roles []Role `json:"roles,omitempty"`
+
 	jwt.RegisteredClaims
 }
 
@@ -33,6 +36,15 @@ type User struct {
 
 	// Set of downvoted messages (by IDs).
 	Downvoted map[string]struct{} `bson:"downvoted"`
+
+	// Roles granted to the user, besides the implicit roleUser.
+	Roles []Role `bson:"roles,omitempty"`
+
+	// Whether the user has been banned by a moderator.
+	Banned bool `bson:"banned,omitempty"`
+
+	// When the user's mute ends, if they have been muted.
+	MutedUntil *time.Time `bson:"mutedUntil,omitempty"`
 }
 
 // Body of requests to the signup and login endpoints.
@@ -50,8 +62,6 @@ func handleSignup(s *Server, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Printf("Username: %v\n", body.Username)
-	log.Printf("Password: %v\n", body.Password)
-	log.Printf("Body: %v\n", body)
 
 	// TODO: Add validation logic.
 
@@ -69,8 +79,7 @@ func handleSignup(s *Server, w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Add new user to database.
-	users := s.db.Collection("users")
-	hash, err := bcrypt.GenerateFromPassword([]byte(body.Password), BCRYPT_ITERATIONS)
+	hash, err := bcrypt.GenerateFromPassword([]byte(body.Password), s.config.BcryptCost)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -82,32 +91,33 @@ func handleSignup(s *Server, w http.ResponseWriter, r *http.Request) {
 		Upvoted:   map[string]struct{}{},
 		Downvoted: map[string]struct{}{},
 	}
-	if _, err := users.InsertOne(s.ctx, newUser); err != nil {
+	if s.adminUsernames()[body.Username] {
+		newUser.Roles = []Role{roleAdmin}
+	}
+	if err := s.store.CreateUser(s.ctx, newUser); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Compute JWT.
+	// Issue tokens.
 	// TODO: Add in rollback logic on error.
-	token, err := generateJWT(body.Username)
+	tokens, err := s.login(body.Username)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	fmt.Fprint(w, token)
-	log.Printf("Created user with username: %v and password %v\n", body.Username, body.Password)
+	writeJSON(w, http.StatusCreated, tokens)
+	log.Printf("Created user with username: %v\n", body.Username)
 }
 
 // Return whether or not a user exists in our database.
 func (s Server) userExists(username string) (bool, error) {
-	users := s.db.Collection("users")
-	err := users.FindOne(s.ctx, bson.M{"username": username}).Err()
+	_, err := s.store.GetUser(s.ctx, username)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if err == errNotFound {
 			return false, nil
 		}
 		return false, err
@@ -125,12 +135,18 @@ func handleLogin(s *Server, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Limit guesses at each account's password. Only failed attempts count,
+	// so that logging in successfully never uses up the limit.
+	if err := s.checkRateLimit(limitAuth, body.Username); err != nil {
+		writeError(w, err)
+		return
+	}
+
 	// Get user from database.
-	users := s.db.Collection("users")
-	var user User
-	if err := users.FindOne(s.ctx, bson.M{"username": body.Username}).Decode(&user); err != nil {
-		if err == mongo.ErrNoDocuments {
-			http.Error(w, "No account with given username and password.", http.StatusForbidden)
+	user, err := s.store.GetUser(s.ctx, body.Username)
+	if err != nil {
+		if err == errNotFound {
+			s.rejectLogin(w, body.Username)
 			return
 		}
 
@@ -141,18 +157,28 @@ func handleLogin(s *Server, w http.ResponseWriter, r *http.Request) {
 
 	// Compare passwords.
 	if err := bcrypt.CompareHashAndPassword(user.Password, []byte(body.Password)); err != nil {
-		http.Error(w, "No account with given username and password.", http.StatusForbidden)
+		s.rejectLogin(w, body.Username)
 		return
 	}
 
-	// Generate JWT.
-	token, err := generateJWT(body.Username)
+	// Issue tokens.
+	tokens, err := s.login(body.Username)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
-	fmt.Fprint(w, token)
-	log.Printf("Successfully authenticated user with username: %v and password %v\n", body.Username, body.Password)
+	writeJSON(w, http.StatusOK, tokens)
+	log.Printf("Successfully authenticated user with username: %v\n", body.Username)
+}
+
+// Count a failed login against the limit on guesses at the user's password,
+// and respond with 403 (FORBIDDEN).
+func (s *Server) rejectLogin(w http.ResponseWriter, username string) {
+	if err := s.takeRateLimit(limitAuth, username, ""); err != nil {
+		if _, ok := err.(*apiError); !ok {
+			log.Println(err)
+		}
+	}
+	http.Error(w, "No account with given username and password.", http.StatusForbidden)
 }